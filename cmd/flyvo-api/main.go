@@ -10,7 +10,6 @@ import (
 	"github.com/tktip/cfger"
 	"github.com/tktip/flyvo-api/internal/api"
 	"github.com/tktip/flyvo-api/internal/version"
-	"github.com/tktip/flyvo-api/pkg/healthcheck"
 )
 
 func main() {
@@ -33,15 +32,17 @@ func main() {
 	// it is good practice to log version on startup
 	logrus.Infof("Running version: %s", version.VERSION)
 
-	//Starting health check
-	go healthcheck.StartHealthService()
-
 	apiSrv := api.Server{}
 	_, err := cfger.ReadStructuredCfg("file::"+cfgFile, &apiSrv)
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == previewCommand {
+		preview(&apiSrv, os.Args[2:])
+		return
+	}
+
 	logrus.Errorf("Api server failed: %s", apiSrv.Run())
 	if apiSrv.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
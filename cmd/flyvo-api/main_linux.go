@@ -3,11 +3,12 @@
 package main
 
 import (
+	"os"
+
 	"github.com/sirupsen/logrus"
 	"github.com/tktip/cfger"
 	"github.com/tktip/flyvo-api/internal/api"
 	"github.com/tktip/flyvo-api/internal/version"
-	"github.com/tktip/flyvo-api/pkg/healthcheck"
 )
 
 func main() {
@@ -24,8 +25,10 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	//Starting health check
-	go healthcheck.StartHealthService()
+	if len(os.Args) > 1 && os.Args[1] == previewCommand {
+		preview(&apiSrv, os.Args[2:])
+		return
+	}
 
 	logrus.Fatalf("Api server failed: %s", apiSrv.Run())
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/api"
+)
+
+//previewCommand - the subcommand previewing the absentee sync
+const previewCommand = "preview"
+
+//preview writes what the absentee sync would report to stdout, without
+//sending or deleting anything.
+func preview(apiSrv *api.Server, args []string) {
+	flags := flag.NewFlagSet(previewCommand, flag.ExitOnError)
+	date := flags.String("date", "", "activities of this day instead of the sync window (yyyy-mm-dd)")
+	format := flags.String("format", api.FormatJSON, "json or csv")
+	_ = flags.Parse(args)
+
+	err := apiSrv.PreviewAbsentees(*date, *format, os.Stdout)
+	if err != nil {
+		logrus.Fatalf("Absentee preview failed: %s", err.Error())
+	}
+}
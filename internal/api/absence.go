@@ -12,6 +12,8 @@ import (
 	"github.com/tktip/flyvo-api/pkg/flyvo"
 	"github.com/tktip/flyvo-api/pkg/rpc"
 
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/tktip/flyvo-api/internal/errorhandler"
@@ -40,8 +42,13 @@ func (s *Server) getSickleaves(c *gin.Context) {
 	layoutISO := "02012006"
 	formatDate := to.Format(layoutISO)
 
+	vismaID, ok := s.vismaID(c, user.Email)
+	if !ok {
+		return
+	}
+
 	req := flyvo.GetSickLeavesRequest{
-		VismaID: extractVismaID(user.Email),
+		VismaID: vismaID,
 		ToDate:  formatDate,
 	}
 
@@ -106,8 +113,13 @@ func (s *Server) getAbsenceCount(c *gin.Context) {
 		return
 	}
 
+	vismaID, ok := s.vismaID(c, user.Email)
+	if !ok {
+		return
+	}
+
 	req := flyvo.GetUnauthorizedAbsenceRequest{
-		VismaID:  extractVismaID(user.Email),
+		VismaID:  vismaID,
 		FromDate: from,
 		ToDate:   to,
 	}
@@ -201,8 +213,13 @@ func (s *Server) registerSickleave(c *gin.Context) {
 	logrus.Info(absence.Start.Format(layoutISO))
 	logrus.Info(absence.End.Format(layoutISO))
 
+	vismaID, ok := s.vismaID(c, person.Email)
+	if !ok {
+		return
+	}
+
 	req := flyvo.RegisterSickLeave{
-		VismaID:  extractVismaID(person.Email),
+		VismaID:  vismaID,
 		Code:     absence.AbsenceCode,
 		FromDate: absence.Start.Format(layoutISO),
 		ToDate:   absence.End.Format(layoutISO),
@@ -224,7 +241,11 @@ func (s *Server) registerSickleave(c *gin.Context) {
 		time.Second*15,
 	)
 
-	if err != nil {
+	if err == flyvorpc.ErrQueued {
+		logrus.Infof("Sick leave for '%s' queued for delivery to FlyVo", req.VismaID)
+		c.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
 		logrus.Errorf("Failed during clientside processing: %s", err.Error())
 		errorhandler.HandleRPCError(c, err)
 		return
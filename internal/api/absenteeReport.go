@@ -0,0 +1,353 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+)
+
+const (
+	//FormatJSON - absentee report as json
+	FormatJSON = "json"
+	//FormatCSV - absentee report as csv, one row per expected participant
+	FormatCSV = "csv"
+)
+
+//absentee - an expected participant counted as absent by the absentee sync
+type absentee struct {
+	Email  string `json:"email"`
+	Status string `json:"status"`
+
+	//AbsenceCode is the code the absence is reported with, empty if it is not.
+	AbsenceCode string `json:"absenceCode,omitempty"`
+	VismaID     string `json:"vismaId,omitempty"`
+
+	//Error is why the absence cannot be reported, if it cannot.
+	Error string `json:"error,omitempty"`
+}
+
+//activityReport - the attendance of an activity, as the absentee sync sees it
+type activityReport struct {
+	ActivityID string     `json:"activityId"`
+	CourseID   string     `json:"courseId"`
+	Start      time.Time  `json:"start"`
+	End        time.Time  `json:"end"`
+	Expected   []string   `json:"expected"`
+	Present    []string   `json:"present"`
+	Absent     []absentee `json:"absent"`
+
+	//SyncState is the state of the absentee sync of the activity, if started.
+	SyncState string `json:"syncState,omitempty"`
+}
+
+//absenteeReport - what the absentee sync would report to FlyVo
+type absenteeReport struct {
+	//Date is the day of the activities reported, if not the sync window.
+	Date       string           `json:"date,omitempty"`
+	Activities []activityReport `json:"activities"`
+}
+
+//reported returns the vismaIDs of the absentees to report, by absence code.
+func (a *activityReport) reported() map[string][]string {
+	reported := map[string][]string{}
+	for _, absentee := range a.Absent {
+		if absentee.AbsenceCode == "" || absentee.VismaID == "" {
+			continue
+		}
+		reported[absentee.AbsenceCode] = append(reported[absentee.AbsenceCode], absentee.VismaID)
+	}
+	return reported
+}
+
+//absenteeReport computes who were present and absent at the activities
+//pending the absentee sync, without changing anything. If @day is set, the
+//activities of that day are included instead of those in the sync window.
+//revive:disable-next-line:cyclomatic
+func (s *Server) absenteeReport(ctx context.Context, day string) (*absenteeReport, error) {
+	to := time.Now()
+	from := to.Add(-s.AbsenteeSync.Window)
+	if day != "" {
+		loc, err := flyvorpc.LoadTimeZone(s.RPC.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		from, err = time.ParseInLocation(layoutISO, day, loc)
+		if err != nil {
+			return nil, fmt.Errorf("bad date '%s'", day)
+		}
+		to = from.AddDate(0, 0, 1)
+	}
+
+	events, err := s.getTodaysEvents(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve events: %s", err.Error())
+	}
+
+	activities := map[string]*activityReport{}
+	absent := map[string]map[string]bool{}
+	for _, event := range events {
+		calendarID := calendarid.Encode(event.activityID)
+		activities[calendarID] = &activityReport{
+			ActivityID: calendarID,
+			CourseID:   event.activityID,
+			Start:      event.Start.DateTime,
+			End:        event.End.DateTime,
+			Expected:   []string{},
+			Present:    []string{},
+			Absent:     []absentee{},
+		}
+		absent[calendarID] = map[string]bool{}
+		for _, attendee := range event.Attendees {
+			absent[calendarID][attendee.Email] = true
+		}
+	}
+
+	logrus.Debugf("Absenteeset size: %d", len(absent))
+
+	//Register those who were actually present
+	held, err := s.repo(ctx).KnownActivities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve activities: %s", err.Error())
+	}
+
+	for _, id := range held {
+		calendarID := calendarid.Encode(id)
+		if absent[calendarID] == nil {
+			continue
+		}
+
+		participations, err := s.repo(ctx).Participations(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve participations: %s", err.Error())
+		}
+		logrus.Debugf("Participations in %s: %d", id, len(participations))
+
+		for _, p := range participations {
+			if !s.Geofence.countsAsPresent(p.Value) {
+				logrus.Infof("Unverified participation counted as absent: %s %s",
+					p.ActivityID,
+					p.Email,
+				)
+				continue
+			}
+
+			absent[calendarID][p.Email] = false
+			logrus.Debugf("%s was present at activity %s", p.Email, id)
+		}
+	}
+
+	report := &absenteeReport{
+		Date:       day,
+		Activities: []activityReport{},
+	}
+	for calendarID, participants := range absent {
+		activity := activities[calendarID]
+
+		state, err := s.loadSync(ctx, calendarID)
+		if err != nil {
+			return nil, err
+		} else if state != nil {
+			activity.SyncState = state.State
+		}
+
+		overrides, err := s.overrides(ctx, calendarID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get overrides for activity '%s': %s",
+				activity.CourseID,
+				err.Error(),
+			)
+		}
+
+		for personEmail, isAbsent := range participants {
+			activity.Expected = append(activity.Expected, personEmail)
+
+			o := overrides[strings.ToLower(personEmail)]
+			if o != nil {
+				isAbsent = o.Status != StatusPresent
+			}
+			if !isAbsent {
+				activity.Present = append(activity.Present, personEmail)
+				continue
+			}
+
+			a := absentee{
+				Email:       personEmail,
+				Status:      StatusAbsent,
+				AbsenceCode: s.AbsenceCodes.code(o),
+			}
+			if o != nil {
+				a.Status = o.Status
+			}
+			if a.AbsenceCode != "" {
+				a.VismaID, err = s.Identity.VismaID(personEmail)
+				if err != nil {
+					a.Error = err.Error()
+				}
+			}
+			activity.Absent = append(activity.Absent, a)
+		}
+
+		sort.Strings(activity.Expected)
+		sort.Strings(activity.Present)
+		sort.Slice(activity.Absent, func(i, j int) bool {
+			return activity.Absent[i].Email < activity.Absent[j].Email
+		})
+		report.Activities = append(report.Activities, *activity)
+	}
+
+	sort.Slice(report.Activities, func(i, j int) bool {
+		return report.Activities[i].ActivityID < report.Activities[j].ActivityID
+	})
+	return report, nil
+}
+
+//writeCSV writes the report with one row per expected participant.
+func (r *absenteeReport) writeCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{
+		"activityId", "courseId", "start", "syncState",
+		"email", "status", "absenceCode", "vismaId", "error",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, activity := range r.Activities {
+		row := func(email, status, code, vismaID, errorText string) error {
+			return out.Write([]string{
+				activity.ActivityID,
+				activity.CourseID,
+				activity.Start.Format(time.RFC3339),
+				activity.SyncState,
+				email,
+				status,
+				code,
+				vismaID,
+				errorText,
+			})
+		}
+
+		for _, email := range activity.Present {
+			err = row(email, StatusPresent, "", "", "")
+			if err != nil {
+				return err
+			}
+		}
+		for _, a := range activity.Absent {
+			err = row(a.Email, a.Status, a.AbsenceCode, a.VismaID, a.Error)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+//write writes the report as json or csv.
+func (r *absenteeReport) write(w io.Writer, format string) error {
+	switch format {
+	case FormatCSV:
+		return r.writeCSV(w)
+	case FormatJSON, "":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+//PreviewAbsentees - writes what the absentee sync would report for activities
+//of @day (yyyy-mm-dd, or the sync window if empty) to @w as json or csv,
+//without sending or deleting anything
+func (s *Server) PreviewAbsentees(day string, format string, w io.Writer) error {
+	err := s.Geofence.init()
+	if err != nil {
+		return err
+	}
+	s.AbsenceCodes.init()
+	s.AbsenteeSync.init()
+	err = s.openStore()
+	if err != nil {
+		return err
+	}
+
+	err = s.Identity.Init(&s.Trovo)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.absenteeReport(context.Background(), day)
+	if err != nil {
+		return err
+	}
+	return report.write(w, format)
+}
+
+// previewAbsentees returns what the absentee sync would report
+// @Summary Previews the absentee sync
+// @Description Returns the expected, present and absent participants of each activity
+// @Description in the absentee sync window, as the sync would report them to FlyVo,
+// @Description without sending or deleting anything
+// @Produce application/json,text/csv
+// @Param date query string false "activities of this day instead of the sync window (yyyy-mm-dd)"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {string} string "the absentee report"
+// @Failure 400 {string} string "If bad date or format"
+// @Failure 403 {string} string "If unauthorized (not department or system admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis or calendar)"
+// @Router /absentees/preview [GET]
+func (s *Server) previewAbsentees(c *gin.Context) {
+	day := c.Query("date")
+	if day != "" {
+		_, err := time.Parse(layoutISO, day)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, codedErrorResponse("bad date value", CodeBadRequest))
+			return
+		}
+	}
+
+	format := c.DefaultQuery("format", FormatJSON)
+	if format != FormatJSON && format != FormatCSV {
+		c.JSON(http.StatusBadRequest, codedErrorResponse(
+			"format must be json or csv",
+			CodeBadRequest,
+		))
+		return
+	}
+
+	report, err := s.absenteeReport(c.Request.Context(), day)
+	if err != nil {
+		logrus.Errorf("Failed to compute absentee report: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to compute absentee report",
+			CodeConnectionError,
+		))
+		return
+	}
+
+	if format == FormatCSV {
+		c.Header("content-type", "text/csv")
+		c.Header("content-disposition", "attachment; filename=absentees.csv")
+		c.Status(http.StatusOK)
+		err = report.writeCSV(c.Writer)
+		if err != nil {
+			logrus.Errorf("Failed to write absentee report: %s", err.Error())
+		}
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+	"github.com/tktip/flyvo-api/pkg/flyvo"
+	"github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+const (
+	//SyncPending - the absentees of the activity are computed, but not sent
+	SyncPending = "pending"
+	//SyncSent - the absentees are sent to FlyVo, but not all are confirmed
+	SyncSent = "sent"
+	//SyncConfirmed - FlyVo has confirmed registering all absentees
+	SyncConfirmed = "confirmed"
+	//SyncCleaned - the participation, activity and overrides are deleted
+	SyncCleaned = "cleaned"
+
+	//syncStateTTL is how long the sync state of an activity is kept.
+	syncStateTTL = 30 * 24 * time.Hour
+
+	//resendAfter is how long a sent request is left to the durable rpc queue
+	//before it is sent again.
+	resendAfter = 12 * time.Hour
+)
+
+//absenceRequest - absentees of an activity registered with one absence code
+type absenceRequest struct {
+	AbsenceCode    string     `json:"absenceCode"`
+	VismaIDs       []string   `json:"vismaIds"`
+	IdempotencyKey string     `json:"idempotencyKey"`
+	State          string     `json:"state"`
+	SentAt         *time.Time `json:"sentAt,omitempty"`
+	Attempts       int        `json:"attempts"`
+	Error          string     `json:"error,omitempty"`
+}
+
+//activitySync - the persisted progress of the absentee sync of an activity.
+//Once created, the requests are not recomputed, so reruns send exactly what
+//the first run would have.
+type activitySync struct {
+	ActivityID string            `json:"activityId"`
+	CourseID   string            `json:"courseId"`
+	Start      time.Time         `json:"start"`
+	State      string            `json:"state"`
+	Requests   []*absenceRequest `json:"requests"`
+	Created    time.Time         `json:"created"`
+	Updated    time.Time         `json:"updated"`
+}
+
+func idempotencyKey(activityID string, code string) string {
+	return "absences-" + activityID + "-" + code
+}
+
+//newActivitySync creates the pending sync of an activity from its report.
+func newActivitySync(activity activityReport) *activitySync {
+	now := time.Now()
+	a := &activitySync{
+		ActivityID: activity.ActivityID,
+		CourseID:   activity.CourseID,
+		Start:      activity.Start,
+		State:      SyncPending,
+		Requests:   []*absenceRequest{},
+		Created:    now,
+		Updated:    now,
+	}
+
+	for code, vismaIDs := range activity.reported() {
+		sort.Strings(vismaIDs)
+		a.Requests = append(a.Requests, &absenceRequest{
+			AbsenceCode:    code,
+			VismaIDs:       vismaIDs,
+			IdempotencyKey: idempotencyKey(activity.ActivityID, code),
+			State:          SyncPending,
+		})
+	}
+	sort.Slice(a.Requests, func(i, j int) bool {
+		return a.Requests[i].AbsenceCode < a.Requests[j].AbsenceCode
+	})
+	return a
+}
+
+//loadSync returns the sync state of the activity, or nil if it has none.
+func (s *Server) loadSync(ctx context.Context, activityID string) (*activitySync, error) {
+	stored, err := s.repo(ctx).SyncState(activityID)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	a := &activitySync{}
+	err = json.Unmarshal(stored, a)
+	if err != nil {
+		return nil, fmt.Errorf("bad sync state for '%s': %s", activityID, err.Error())
+	}
+	return a, nil
+}
+
+func (s *Server) saveSync(a *activitySync) error {
+	a.Updated = time.Now()
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return s.repository.SaveSyncState(a.ActivityID, data, syncStateTTL)
+}
+
+//outstandingSyncs returns the sync states of activities not yet cleaned.
+func (s *Server) outstandingSyncs() ([]*activitySync, error) {
+	states, err := s.repository.SyncStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var outstanding []*activitySync
+	for _, stored := range states {
+		a := &activitySync{}
+		err = json.Unmarshal(stored, a)
+		if err != nil {
+			return nil, fmt.Errorf("bad sync state: %s", err.Error())
+		} else if a.State != SyncCleaned {
+			outstanding = append(outstanding, a)
+		}
+	}
+	return outstanding, nil
+}
+
+//advance moves the sync of an activity as far as it can go, persisting each
+//step and recording it in the run, and returns whether any step failed.
+func (s *Server) advance(activityID string, run *syncRun) (failed bool) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	a, err := s.loadSync(context.Background(), activityID)
+	if err != nil {
+		logrus.Errorf("Failed to load sync state of '%s': %s", activityID, err.Error())
+		return true
+	} else if a == nil || a.State == SyncCleaned {
+		return false
+	}
+
+	for _, req := range a.Requests {
+		if req.State == SyncConfirmed ||
+			(req.State == SyncSent && time.Since(*req.SentAt) < resendAfter) {
+			continue
+		}
+
+		err = s.sendAbsentees(a, req)
+		if err != nil {
+			failed = true
+			req.Error = err.Error()
+			run.fail(a, req.AbsenceCode, err)
+		}
+		err = s.saveSync(a)
+		if err != nil {
+			logrus.Errorf("Failed to save sync state of '%s': %s", a.ActivityID, err.Error())
+			run.fail(a, "", err)
+			run.record(a)
+			return true
+		}
+	}
+
+	if s.settle(a) {
+		failed = true
+		run.fail(a, "", errors.New("failed to save sync state or delete keys"))
+	}
+	run.record(a)
+	return failed
+}
+
+//settle updates the state of the activity from its requests, and cleans up
+//once all are confirmed. Returns whether it failed.
+func (s *Server) settle(a *activitySync) (failed bool) {
+	confirmed := true
+	sent := false
+	for _, req := range a.Requests {
+		confirmed = confirmed && req.State == SyncConfirmed
+		sent = sent || req.State != SyncPending
+	}
+
+	previous := a.State
+	if confirmed {
+		a.State = SyncConfirmed
+	} else if sent {
+		a.State = SyncSent
+	}
+	if a.State != previous {
+		err := s.saveSync(a)
+		if err != nil {
+			logrus.Errorf("Failed to save sync state of '%s': %s", a.ActivityID, err.Error())
+			return true
+		}
+	}
+
+	if a.State != SyncConfirmed {
+		return false
+	}
+
+	err := s.dropActivity(a.CourseID)
+	if err != nil {
+		logrus.Errorf("Failed to clean up activity '%s': %s", a.ActivityID, err.Error())
+		return true
+	}
+
+	a.State = SyncCleaned
+	err = s.saveSync(a)
+	if err != nil {
+		logrus.Errorf("Failed to save sync state of '%s': %s", a.ActivityID, err.Error())
+		return true
+	}
+	logrus.Infof("Absentee sync of activity '%s' done", a.ActivityID)
+	return false
+}
+
+//sendAbsentees registers the absentees of a request at FlyVo. The request is
+//confirmed if FlyVo responds, or sent if it is queued for delivery.
+func (s *Server) sendAbsentees(a *activitySync, req *absenceRequest) error {
+	logrus.Debugf("Registering %d absentees (%s) from %s",
+		len(req.VismaIDs),
+		req.AbsenceCode,
+		a.ActivityID,
+	)
+
+	body := flyvo.RegisterAbsenceRequest{
+		CourseID:    a.CourseID,
+		AbsenteeIds: req.VismaIDs,
+		AbsenceCode: req.AbsenceCode,
+	}
+
+	gen := rpc.Generic{
+		Path: rpc.PathRegisterAbsences,
+		Headers: map[string]string{
+			rpc.HeaderIdempotencyKey: req.IdempotencyKey,
+		},
+	}
+
+	var err error
+	gen.Body, err = json.Marshal(body)
+	if err != nil {
+		logrus.Fatalf("failed to marshal body: %s", err.Error())
+	}
+
+	now := time.Now()
+	req.Attempts++
+
+	//Inform Flyvo
+	logrus.Debug("Awaiting clientside processing..")
+	response, err := s.RPC.WaitForClientsideProcessing(&gen, time.Second*30)
+	if err == flyvorpc.ErrQueued {
+		logrus.Infof("Absentees (%s) for activity '%s' queued for delivery to FlyVo",
+			req.AbsenceCode,
+			a.ActivityID,
+		)
+		req.State = SyncSent
+		req.SentAt = &now
+		req.Error = ""
+		return nil
+	} else if err != nil {
+		logrus.Errorf("Failed to register absentees due to error: %s", err.Error())
+		return err
+	} else if response.Status != http.StatusOK && response.Status != http.StatusNoContent {
+		logrus.Errorf("Failed to register absentees, unexpected response (%d): %s",
+			response.Status,
+			response.Body,
+		)
+		return errorWrongResponseCodeFlyvoRPC(response)
+	}
+
+	logrus.Infof("Successfully registered absentees (%s) for activity '%s'",
+		req.AbsenceCode,
+		a.ActivityID,
+	)
+	req.State = SyncConfirmed
+	req.SentAt = &now
+	req.Error = ""
+	return nil
+}
+
+//absencesDelivered confirms absentees that were queued, once FlyVo responds.
+func (s *Server) absencesDelivered(req *rpc.Generic, response *rpc.Generic) {
+	if req.Path != rpc.PathRegisterAbsences {
+		return
+	}
+
+	key := req.Headers[rpc.HeaderIdempotencyKey]
+	parts := strings.SplitN(key, "-", 3)
+	if len(parts) != 3 {
+		logrus.Warnf("Delivered absentees without idempotency key: %s", req.MsgID)
+		return
+	}
+	confirmed := response.Status == http.StatusOK || response.Status == http.StatusNoContent
+	if !confirmed {
+		logrus.Errorf("Queued absentees '%s' failed, unexpected response (%d)",
+			key,
+			response.Status,
+		)
+	}
+
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	a, err := s.loadSync(context.Background(), parts[1])
+	if err != nil || a == nil {
+		logrus.Errorf("No sync state for delivered absentees '%s': %v", key, err)
+		return
+	}
+
+	//Failed requests are left as sent, to be sent again by a later run
+	for _, r := range a.Requests {
+		if r.IdempotencyKey != key {
+			continue
+		} else if confirmed {
+			r.State = SyncConfirmed
+			r.Error = ""
+		} else {
+			r.Error = errorWrongResponseCodeFlyvoRPC(*response).Error()
+		}
+	}
+	err = s.saveSync(a)
+	if err != nil {
+		logrus.Errorf("Failed to save sync state of '%s': %s", a.ActivityID, err.Error())
+		return
+	}
+	s.settle(a)
+}
@@ -0,0 +1,114 @@
+package api
+
+//revive:disable:line-length-limit
+
+import (
+	"bytes"
+	"html/template"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sheetQrSize = 480
+)
+
+var (
+	sheetTemplate = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Attendance - {{.ActivityID}}</title>
+<style>
+	body { font-family: sans-serif; text-align: center; margin: 2em; }
+	h1 { font-size: 1.5em; }
+	.qr svg { width: 60vmin; height: 60vmin; }
+	.code { font-family: monospace; font-size: 4em; letter-spacing: 0.15em; margin: 0.5em 0; }
+	.link { word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Register attendance for {{.ActivityID}}</h1>
+<div class="qr">{{.QR}}</div>
+<p>Scan the code, or open the link below and enter:</p>
+<div class="code">{{.Code}}</div>
+<p class="link">{{.Link}}</p>
+<p>The code changes every {{.Rotation}}. This page refreshes automatically.</p>
+</body>
+</html>
+`))
+)
+
+type sheetData struct {
+	ActivityID string
+	Code       string
+	Link       string
+	QR         template.HTML
+	Rotation   time.Duration
+	Refresh    int
+}
+
+// getAttendanceSheet returns an attendance sheet for an event, to be shown on a screen
+// @Summary Attendance sheet for a screen
+// @Description Opens an attendance session for the activity, unless one is open, and returns an HTML page with the QR code and participation ID.
+// @Description The page refreshes when the ID rotates, so show it on a screen in the room. The ID expires soon after it rotates, so the page is not meant to be printed.
+// @Produce text/html
+// @Param activityId query string true "id of an existing event"
+// @Success 200 {string} string "The attendance sheet"
+// @Failure 403 {string} string "If unauthorized (not teacher in GCE)"
+// @Failure 500 {string} string "On any other error"
+// @Router /generate/sheet [GET]
+func (s *Server) getAttendanceSheet(c *gin.Context) {
+	activityID := c.Query("activityId")
+	if activityID == "" {
+		c.JSON(http.StatusBadRequest, codedErrorResponse(
+			"missing activityId",
+			CodeBadRequest,
+		))
+		return
+	}
+
+	code, ok := s.openSession(c, activityID)
+	if !ok {
+		return
+	}
+
+	qrCode, ok := s.participantQrCode(c, code.Code)
+	if !ok {
+		return
+	}
+
+	refresh := int(math.Ceil(time.Until(code.RotatesAt).Seconds()))
+	if refresh < 1 {
+		refresh = 1
+	}
+
+	data := sheetData{
+		ActivityID: activityID,
+		Code:       code.Code,
+		Link:       s.ParticipantURL + "?id=" + code.Code,
+		//Generated by us, so safe to embed.
+		QR:       template.HTML(qrCode.SVG(sheetQrSize)),
+		Rotation: s.Attendance.Rotation,
+		Refresh:  refresh,
+	}
+
+	buf := &bytes.Buffer{}
+	err := sheetTemplate.Execute(buf, data)
+	if err != nil {
+		logrus.Errorf("Failed to render attendance sheet: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to render attendance sheet",
+			CodeInternalErrorGeneral,
+		))
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
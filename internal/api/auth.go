@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	jwtsessions "github.com/tktip/google-auth-proxy/pkg/jwt-sessions"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	defaultAuthHeader = "userInfo"
+)
+
+//Auth - verification of the users forwarded by google-auth-proxy
+type Auth struct {
+	//Header holding the signed token from the auth proxy. Defaults to 'userInfo'.
+	Header string `yaml:"header"`
+
+	//PublicKey is the PEM encoded RSA public key of the auth proxy.
+	PublicKey string `yaml:"publicKey"`
+
+	//JWKS is a JSON web key set with the public keys of the auth proxy.
+	JWKS string `yaml:"jwks"`
+
+	//Audience the tokens must be issued for. If empty, tokens carrying an
+	//audience are rejected.
+	Audience string `yaml:"audience"`
+
+	//DevImpersonation skips verification and treats every request as coming
+	//from the given person. Never enable in production.
+	DevImpersonation struct {
+		Enabled    bool   `yaml:"enabled"`
+		Email      string `yaml:"email"`
+		GivenName  string `yaml:"givenName"`
+		FamilyName string `yaml:"familyName"`
+		Teacher    bool   `yaml:"teacher"`
+		Roles      []Role `yaml:"roles"`
+	} `yaml:"devImpersonation"`
+
+	keys map[string]*rsa.PublicKey
+}
+
+//init loads the verification keys.
+//revive:disable-next-line:cyclomatic
+func (a *Auth) init() error {
+	if a.Header == "" {
+		a.Header = defaultAuthHeader
+	}
+
+	if a.DevImpersonation.Enabled {
+		for i := 0; i < 3; i++ {
+			logrus.Warn("!!! AUTHENTICATION DISABLED - DEV IMPERSONATION ENABLED !!!")
+		}
+		logrus.Warnf("!!! Every request is treated as coming from '%s' (roles: %v) !!!",
+			a.DevImpersonation.Email,
+			a.impersonatedRoles(),
+		)
+		return nil
+	}
+
+	a.keys = map[string]*rsa.PublicKey{}
+	if a.PublicKey != "" {
+		key, err := parseRSAPublicKey(a.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse auth public key: %s", err.Error())
+		}
+		a.keys[""] = key
+	}
+
+	if a.JWKS != "" {
+		set := jose.JSONWebKeySet{}
+		err := json.Unmarshal([]byte(a.JWKS), &set)
+		if err != nil {
+			return fmt.Errorf("failed to parse auth jwks: %s", err.Error())
+		}
+
+		for _, jwk := range set.Keys {
+			key, ok := jwk.Key.(*rsa.PublicKey)
+			if !ok {
+				logrus.Warnf("Ignoring non-RSA key '%s' in auth jwks", jwk.KeyID)
+				continue
+			}
+			a.keys[jwk.KeyID] = key
+		}
+	}
+
+	if len(a.keys) == 0 {
+		return errors.New("auth requires publicKey or jwks, or devImpersonation enabled")
+	}
+
+	logrus.Infof("Verifying users with %d auth proxy key(s)", len(a.keys))
+	return nil
+}
+
+//parseRSAPublicKey parses a PEM encoded PKIX or PKCS1 RSA public key.
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return key, nil
+}
+
+//key finds the key the token is to be verified with.
+func (a *Auth) key(token *jwt.JSONWebToken) (*rsa.PublicKey, error) {
+	if len(token.Headers) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+
+	header := token.Headers[0]
+	switch jose.SignatureAlgorithm(header.Algorithm) {
+	case jose.RS256, jose.RS384, jose.RS512:
+	default:
+		return nil, fmt.Errorf("unexpected signing method '%s'", header.Algorithm)
+	}
+
+	if key, ok := a.keys[header.KeyID]; ok {
+		return key, nil
+	}
+
+	//Tokens without key ID are accepted if there is only one key to try.
+	if header.KeyID == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key with id '%s'", header.KeyID)
+}
+
+//verify parses and verifies a token from the auth proxy and returns the person
+//it was issued for.
+func (a *Auth) verify(raw string) (*jwtsessions.GToken, error) {
+	raw = strings.TrimSpace(strings.TrimPrefix(raw, "Bearer "))
+
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.key(token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.Claims{}
+	custom := struct {
+		Gauth *jwtsessions.GToken `json:"gauth"`
+	}{}
+	err = token.Claims(key, &claims, &custom)
+	if err != nil {
+		return nil, err
+	}
+
+	//Validate only checks expiry if the claim is present.
+	if claims.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+
+	expected := jwt.Expected{Time: time.Now()}
+	if a.Audience != "" {
+		expected.Audience = jwt.Audience{a.Audience}
+	} else if len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("token is issued for %v", []string(claims.Audience))
+	}
+
+	err = claims.Validate(expected)
+	if err != nil {
+		return nil, err
+	}
+
+	person := custom.Gauth
+	if person == nil {
+		return nil, errors.New("token has no gauth claim")
+	}
+
+	if person.Email == "" {
+		return nil, errors.New("token has no email")
+	}
+
+	person.JTI = claims.ID
+	return person, nil
+}
+
+//impersonated returns the configured dev person.
+func (a *Auth) impersonated() *jwtsessions.GToken {
+	return &jwtsessions.GToken{
+		Email:         a.DevImpersonation.Email,
+		EmailVerified: true,
+		GivenName:     a.DevImpersonation.GivenName,
+		FamilyName:    a.DevImpersonation.FamilyName,
+	}
+}
+
+//impersonatedRoles returns the roles of the configured dev person.
+func (a *Auth) impersonatedRoles() []Role {
+	roles := []Role{RoleStudent}
+	if a.DevImpersonation.Teacher {
+		roles = append(roles, RoleTeacher)
+	}
+	for _, role := range a.DevImpersonation.Roles {
+		if !hasRole(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
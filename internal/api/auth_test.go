@@ -0,0 +1,90 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	jwtsessions "github.com/tktip/google-auth-proxy/pkg/jwt-sessions"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestAuthVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(signer *rsa.PrivateKey, claims jwt.Claims) string {
+		s, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.RS256, Key: signer},
+			(&jose.SignerOptions{}).WithType("JWT"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gauth := map[string]interface{}{
+			"gauth": jwtsessions.GToken{Email: "ola@example.com"},
+		}
+		raw, err := jwt.Signed(s).Claims(claims).Claims(gauth).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	future := jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+	past := jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))
+
+	tests := []struct {
+		name     string
+		audience string
+		token    string
+		ok       bool
+	}{
+		{"valid", "", sign(key, jwt.Claims{ID: "1", Expiry: future}), true},
+		{"bearer", "", "Bearer " + sign(key, jwt.Claims{Expiry: future}), true},
+		{"expired", "", sign(key, jwt.Claims{Expiry: past}), false},
+		{"no expiry", "", sign(key, jwt.Claims{}), false},
+		{"wrong key", "", sign(other, jwt.Claims{Expiry: future}), false},
+		{"unexpected audience", "",
+			sign(key, jwt.Claims{Expiry: future, Audience: jwt.Audience{"other"}}), false},
+		{"audience", "flyvo",
+			sign(key, jwt.Claims{Expiry: future, Audience: jwt.Audience{"flyvo"}}), true},
+		{"wrong audience", "flyvo",
+			sign(key, jwt.Claims{Expiry: future, Audience: jwt.Audience{"other"}}), false},
+		{"missing audience", "flyvo", sign(key, jwt.Claims{Expiry: future}), false},
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &Auth{PublicKey: public, Audience: test.audience}
+			err := a.init()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			person, err := a.verify(test.token)
+			if test.ok != (err == nil) {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if test.ok && person.Email != "ola@example.com" {
+				t.Fatalf("got email '%s'", person.Email)
+			}
+		})
+	}
+}
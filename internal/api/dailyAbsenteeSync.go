@@ -2,36 +2,64 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
-	"strings"
+	neturl "net/url"
+	"sync"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/robfig/cron"
 	"github.com/sirupsen/logrus"
-	"github.com/tktip/flyvo-api/pkg/flyvo"
-	"github.com/tktip/flyvo-api/pkg/rpc"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
 )
 
-type eventSet map[string]map[string]bool
+const (
+	defaultSyncWindow  = 24 * time.Hour
+	defaultSyncWorkers = 4
+	defaultGcalTimeout = 10 * time.Second
+)
+
+//AbsenteeSync - which events the absentee sync considers, and how it fetches them
+type AbsenteeSync struct {
+	//Window is how far back from the run events must start and end. Defaults to 24h.
+	Window time.Duration `yaml:"window"`
+
+	//Workers is how many events are fetched from the calendar at a time. Defaults to 4.
+	Workers int `yaml:"workers"`
+
+	//Timeout of each request to the calendar. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	client *http.Client
+}
+
+func (a *AbsenteeSync) workers() int {
+	if a.Workers <= 0 {
+		return defaultSyncWorkers
+	}
+	return a.Workers
+}
+
+func (a *AbsenteeSync) init() {
+	if a.Window <= 0 {
+		a.Window = defaultSyncWindow
+	}
+	if a.Workers <= 0 {
+		a.Workers = defaultSyncWorkers
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = defaultGcalTimeout
+	}
+	a.client = &http.Client{Timeout: a.Timeout}
+}
+
 type gcalResp struct {
 	Events struct {
-		Items []struct {
-			ID        string `json:"id"`
-			Attendees []struct {
-				Email string `json:"email"`
-			} `json:"attendees"`
-			Status string `json:"status"`
-			Start  struct {
-				DateTime time.Time `json:"dateTime"`
-			} `json:"start"`
-			End struct {
-				DateTime time.Time `json:"dateTime"`
-			} `json:"end"`
-		} `json:"items"`
+		Items         []gEvent `json:"items"`
+		NextPageToken string   `json:"nextPageToken"`
 	} `json:"events"`
 }
 
@@ -47,6 +75,9 @@ type gEvent struct {
 	End struct {
 		DateTime time.Time `json:"dateTime"`
 	} `json:"end"`
+
+	//activityID is the visma id of the activity of the event.
+	activityID string
 }
 
 type gcalSingleResp struct {
@@ -55,206 +86,246 @@ type gcalSingleResp struct {
 
 //TimeWithinLimits - checks that the start and end times are within the bounds of limit
 func TimeWithinLimits(start, end, startLimit, endLimit time.Time) bool {
-	startAfterEnd := endLimit.After(start)
-	startBeforeStart := start.Before(startLimit)
-	endAfterEnd := endLimit.After(end)
-	endBeforeStart := end.Before(startLimit)
-	return !(startAfterEnd || startBeforeStart || endAfterEnd || endBeforeStart)
+	return !start.Before(startLimit) && !end.After(endLimit) && !end.Before(start)
 }
 
-var (
-	invalidChars = regexp.MustCompile(`([a-z0-9])*`)
-)
+//gcalClient returns the client for requests to the calendar.
+func (s *Server) gcalClient() *http.Client {
+	if s.AbsenteeSync.client == nil {
+		return &http.Client{Timeout: defaultGcalTimeout}
+	}
+	return s.AbsenteeSync.client
+}
 
-func sanitizeCalendarID(ID string) string {
-	return strings.Join(invalidChars.FindAllString(strings.ToLower(ID), -1), "")
+//getEvent returns the calendar event of the activity, or nil if the calendar
+//does not have it. Events published by earlier versions are found by their
+//legacy id.
+func (s *Server) getEvent(activityID string) (*gEvent, error) {
+	event, err := s.fetchEvent(calendarid.Encode(activityID))
+	if err == nil && event == nil {
+		event, err = s.fetchEvent(calendarid.Legacy(activityID))
+	}
+	if event != nil {
+		event.activityID = activityID
+	}
+	return event, err
 }
 
-func (s *Server) getTodaysEvents() (eventSet, error) {
-	list, err := s.Redis.GetList("activity-*")
+//fetchEvent returns the calendar event with @eventID, or nil if the calendar
+//does not have it.
+func (s *Server) fetchEvent(eventID string) (*gEvent, error) {
+	url := s.GcalURL + eventGet + eventID
+	resp, err := s.gcalClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	flyvorpc.CountGcalResponse(eventGet, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		logrus.Warnf("Unexpected status for event '%s' from calendar: %s",
+			eventID,
+			resp.Status,
+		)
+		return nil, nil
+	}
+
+	result := gcalSingleResp{}
+	b, _ := ioutil.ReadAll(resp.Body)
+	err = json.NewDecoder(bytes.NewReader(b)).Decode(&result)
 	if err != nil {
 		return nil, err
 	}
+	return &result.Event, nil
+}
+
+//listEvents returns the events of the calendar between @from and @to,
+//following pages until the calendar has no more.
+func (s *Server) listEvents(from, to time.Time) ([]gEvent, error) {
+	url := s.GcalURL + fmt.Sprintf(eventList,
+		neturl.PathEscape(from.Format(time.RFC3339)),
+		neturl.PathEscape(to.Format(time.RFC3339)),
+	)
+
+	var events []gEvent
+	pageToken := ""
+	for {
+		pageURL := url
+		if pageToken != "" {
+			pageURL += "?pageToken=" + neturl.QueryEscape(pageToken)
+		}
 
-	var googleEvents []gEvent
-	for _, key := range list {
-		activityID := strings.Split(key, "-")[2]
-		url := s.GcalURL + eventGet + sanitizeCalendarID(activityID)
-		resp, err := http.Get(url)
+		resp, err := s.gcalClient().Get(pageURL)
 		if err != nil {
 			return nil, err
 		}
 
-		defer resp.Body.Close()
+		flyvorpc.CountGcalResponse(eventList, resp.StatusCode)
 		if resp.StatusCode != http.StatusOK {
-			logrus.Warnf("Unexpected status for activity '%s' from calendar: %s",
-				activityID,
-				resp.Status,
-			)
-			continue
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status listing events: %s", resp.Status)
 		}
-		result := gcalSingleResp{}
-		b, _ := ioutil.ReadAll(resp.Body)
-		err = json.NewDecoder(bytes.NewReader(b)).Decode(&result)
+
+		result := gcalResp{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
 		if err != nil {
 			return nil, err
 		}
-		googleEvents = append(googleEvents, result.Event)
-	}
 
-	eSet := make(eventSet)
-	for _, event := range googleEvents {
-		if event.Status != "confirmed" {
-			continue
+		events = append(events, result.Events.Items...)
+		if result.Events.NextPageToken == "" || result.Events.NextPageToken == pageToken {
+			return events, nil
 		}
+		pageToken = result.Events.NextPageToken
+	}
+}
 
-		eSet[event.ID] = map[string]bool{}
-		for _, attendee := range event.Attendees {
-			eSet[event.ID][attendee.Email] = true
-		}
+//getTodaysEvents returns the confirmed calendar events of the activities
+//pending the absentee sync that start and end between @from and @to. Events
+//are selected from the calendar list, and then fetched by a pool of workers
+//for their full list of attendees.
+func (s *Server) getTodaysEvents(ctx context.Context, from, to time.Time) ([]gEvent, error) {
+	listed, err := s.listEvents(from, to)
+	if err != nil {
+		return nil, err
 	}
 
-	return eSet, nil
-}
+	activities, err := s.repo(ctx).Activities()
+	if err != nil {
+		return nil, err
+	}
+	//Events are matched to the activities by their id, or the legacy id of
+	//events published by earlier versions
+	pending := map[string]string{}
+	for _, activityID := range activities {
+		pending[calendarid.Legacy(activityID)] = activityID
+	}
+	for _, activityID := range activities {
+		pending[calendarid.Encode(activityID)] = activityID
+	}
 
-//revive:disable
+	ids := make(chan string)
+	go func() {
+		defer close(ids)
+		for _, event := range listed {
+			if event.Status == "confirmed" && pending[event.ID] != "" &&
+				TimeWithinLimits(event.Start.DateTime, event.End.DateTime, from, to) {
+				ids <- event.ID
+			}
+		}
+	}()
+
+	var (
+		lock         sync.Mutex
+		wg           sync.WaitGroup
+		googleEvents []gEvent
+		firstErr     error
+	)
+	for i := 0; i < s.AbsenteeSync.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				event, err := s.fetchEvent(id)
+
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to get event '%s': %s", id, err.Error())
+				} else if event != nil && event.Status == "confirmed" {
+					event.activityID = pending[id]
+					googleEvents = append(googleEvents, *event)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
 
-func (s *Server) ginRegisterAbsentees(c *gin.Context) {
-	s.registerAbsentees()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return googleEvents, nil
 }
 
-func (s *Server) absenteeCronJob() {
+//absenteeCronJob runs the absentee sync, retrying failed activities up to 10
+//times a minute apart.
+func (s *Server) absenteeCronJob() error {
 	logrus.Info("Running absenteeCronJob")
+	run := newSyncRun()
+	s.saveRun(run)
 	for i := 0; i < 10; i++ {
-		doRetry := s.registerAbsentees()
+		run.Attempts = i + 1
+		doRetry := s.registerAbsentees(run)
 		if !doRetry {
+			absenteeSyncRuns.Inc("success")
 			logrus.Info("No absentee failures.")
-			return
+			run.finish(RunSuccess)
+			s.saveRun(run)
+			return nil
 		}
 
+		absenteeSyncRuns.Inc("retry")
+		s.saveRun(run)
 		logrus.Info("One or more absentees failed, trying again in 60s.")
 		time.Sleep(time.Second * 60)
 	}
+	absenteeSyncRuns.Inc("failed")
+	logrus.Error("Giving up registering absentees after 10 attempts.")
+	run.finish(RunFailed)
+	s.saveRun(run)
+	return fmt.Errorf("gave up after 10 attempts, see sync run '%s'", run.ID)
 }
 
-func (s *Server) startAbsenteeCronJob() error {
-	c := cron.New()
-
-	logrus.Infof("Starting absentee cron job with string '%s'", s.AbsenteeCronString)
-	err := c.AddFunc(s.AbsenteeCronString, s.absenteeCronJob)
-	if err != nil {
-		return err
-	}
-	c.Start()
-	logrus.Info("Successfully started cron job.")
-	return nil
-}
-
-//revive:enable
-
-//revive:disable-next-line:cyclomatic
-func (s *Server) registerAbsentees() (anyFails bool) {
+//registerAbsentees syncs the absentees of every activity pending the sync.
+//Each activity's sync is persisted as it progresses, so a rerun only does what
+//is outstanding. What is done is recorded in the run.
+func (s *Server) registerAbsentees(run *syncRun) (anyFails bool) {
 
 	logrus.Debug("Running registerAbsentees")
 
-	//Get all events for last 24 hours
-	absenteeSet, err := s.getTodaysEvents()
+	report, err := s.absenteeReport(context.Background(), "")
 	if err != nil {
-		logrus.Errorf("Failed to retrieve events for registerAbsentees: %s", err.Error())
-		return
+		logrus.Errorf("Failed to compute absentees for registerAbsentees: %s", err.Error())
+		run.Error = err.Error()
+		return true
 	}
+	run.Error = ""
 
-	logrus.Debugf("Absenteeset size: %d", len(absenteeSet))
-
-	//Register those who were actually present
-	participationKeys, err := s.Redis.GetList("participation-*")
-	if err != nil {
-		logrus.Errorf("Failed to retrieve participation keys: %s", err.Error())
-		return
-	}
-	logrus.Debugf("Participation keys length: %d", len(participationKeys))
-
-	for _, key := range participationKeys {
-		details := strings.Split(key, "-")
-		activityID := sanitizeCalendarID(details[2])
-		participantID := details[3]
-		if absenteeSet[activityID] == nil {
-			logrus.Warnf("Participation registered for event that did not exist today: %s", key)
+	//Start the sync of activities that have none, keeping the absentees of
+	//those already started as they were
+	for _, activity := range report.Activities {
+		if activity.SyncState != "" {
 			continue
 		}
 
-		absenteeSet[activityID][participantID] = false
-		logrus.Debugf("%s was present at activity %s", participantID, activityID)
-	}
-
-	//Loop through participant set and register absentees
-	for activityID, participants := range absenteeSet {
-		absentList := []string{}
-
-		//extract the absent
-		for personEmail, absent := range participants {
-			if absent {
-				logrus.Debugf("%s was absent from activity %s",
-					personEmail,
-					activityID,
-				)
-				absentList = append(absentList, extractVismaID(personEmail))
+		for _, a := range activity.Absent {
+			if a.Error != "" {
+				logrus.Warnf("Unable to register absence of '%s': %s", a.Email, a.Error)
 			}
 		}
 
-		logrus.Debugf("Registering %d absentees from %s",
-			len(absentList),
-			activityID,
-		)
-
-		if len(absentList) > 0 {
-			body := flyvo.RegisterAbsenceRequest{
-				CourseID: strings.ToUpper(activityID[0:1]) + "." +
-					strings.ToUpper(activityID[1:]),
-				AbsenteeIds: absentList,
-				AbsenceCode: "U",
-			}
-
-			gen := rpc.Generic{
-				Path: rpc.PathRegisterAbsences,
-			}
-
-			gen.Body, err = json.Marshal(body)
-			if err != nil {
-				logrus.Fatalf("failed to marshal body: %s", err.Error())
-			}
-
-			//Inform Flyvo
-			logrus.Debug("Awaiting clientside processing..")
-			response, err := s.RPC.WaitForClientsideProcessing(&gen, time.Second*30)
-			if err != nil {
-				anyFails = true
-				logrus.Errorf("Failed to register absentees due to error: %s", err.Error())
-				continue
-			} else if response.Status != http.StatusOK && response.Status != http.StatusNoContent {
-				anyFails = true
-				logrus.Errorf("Failed to register absentees, unexpected response (%d): %s",
-					response.Status,
-					response.Body,
-				)
-				continue
-			}
-
-			//On success, delete the keys
-			logrus.Infof("Successfully registered absentees for activity '%s'", activityID)
-		}
-		err = s.Redis.DeleteRegex("participation-" +
-			strings.ToUpper(activityID[0:1]) + "." +
-			strings.ToUpper(activityID[1:]) + "*")
+		a := newActivitySync(activity)
+		err = s.saveSync(a)
 		if err != nil {
-			logrus.Infof("Failed to delete participation  details for activity '%s'", activityID)
+			logrus.Errorf("Failed to save sync state of '%s': %s", activity.ActivityID, err.Error())
+			anyFails = true
+			run.fail(a, "", err)
+			continue
 		}
+		run.activity(a).Absent = activity.Absent
+	}
 
-		err = s.Redis.DeleteRegex("activity-" +
-			strings.ToUpper(activityID[0:1]) + "." +
-			strings.ToUpper(activityID[1:]) + "*")
-		if err != nil {
-			logrus.Infof("Failed to delete redis activity for activity '%s'", activityID)
+	outstanding, err := s.outstandingSyncs()
+	if err != nil {
+		logrus.Errorf("Failed to retrieve outstanding absentee syncs: %s", err.Error())
+		run.Error = err.Error()
+		return true
+	}
+
+	for _, a := range outstanding {
+		if s.advance(a.ActivityID, run) {
+			anyFails = true
 		}
 	}
 
@@ -34,6 +34,15 @@ const (
 
 	//CodeInternalErrorGeneral - for general errors.
 	CodeInternalErrorGeneral
+
+	//CodeTooManyAttempts - too many failed attempts, try again later
+	CodeTooManyAttempts
+
+	//CodeSessionClosed - the attendance session has been closed
+	CodeSessionClosed
+
+	//CodeOutsideGeofence - not at the location of the activity
+	CodeOutsideGeofence
 )
 
 func codedErrorResponse(msg string, code errorCode) gin.H {
@@ -14,6 +14,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/tktip/flyvo-api/internal/attendance"
 	"github.com/tktip/flyvo-api/internal/errorhandler"
 )
 
@@ -33,10 +34,6 @@ const (
 // @Failure 500 {string} string "On any other error (e.g. rpc)"
 // @Router /event/retrieve [GET]
 func (s *Server) getEventsForTeacher(c *gin.Context) {
-	if !isTeacher(c) {
-		return
-	}
-
 	DateFromInclusive := c.Param("from")
 	DateToInclusive := c.Param("to")
 
@@ -95,10 +92,6 @@ func (s *Server) getEventsForTeacher(c *gin.Context) {
 
 	if err != nil {
 		logrus.Errorf("Failed during clientside processing: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, codedErrorResponse(
-			"Error communicating with FlyVO",
-			CodeConnectionError,
-		))
 		errorhandler.HandleRPCError(c, err)
 		return
 	}
@@ -120,9 +113,14 @@ func (s *Server) getEventsForTeacher(c *gin.Context) {
 // @Summary Register participation
 // @Description Registers a person as having participated in an event
 // @Produce application/json
-// @Param activityId query string true "activity a person wants to participate in"
-// @Success 200 {string} string "If participant was successfully registered in event"
-// @Failure 422 {string} string "No activity mapped to provided id"
+// @Param participationId query string true "participation ID shown for the activity"
+// @Param lat query number false "latitude reported by the participant's device"
+// @Param lon query number false "longitude reported by the participant's device"
+// @Param accuracy query number false "accuracy of the reported position, in meters, required for the position to be verified"
+// @Success 204 {string} string "If participant was successfully registered in event"
+// @Failure 403 {string} string "If not at the location of the activity, and unverified participation is rejected"
+// @Failure 422 {string} string "No open session with the provided id"
+// @Failure 429 {string} string "If too many ids were provided recently"
 // @Failure 500 {string} string "On any unexpected error (e.g. unable to connect to Redis)"
 // @Router /event/participate/ [GET]
 func (s *Server) registerParticipation(c *gin.Context) {
@@ -133,25 +131,39 @@ func (s *Server) registerParticipation(c *gin.Context) {
 	}
 
 	participationID := c.Query("participationId")
-	activityID, err := s.Redis.GetStringValue(participationID)
-	if err != nil {
-		logrus.Errorf("Failed to read activity ID from redis: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, codedErrorResponse(
-			"unable to retrieve activity data from db",
-			CodeRedisError,
+	activityID, err := s.Attendance.Verify(participationID, person.Email)
+	switch err {
+	case nil:
+	case attendance.ErrTooManyAttempts:
+		c.JSON(http.StatusTooManyRequests, codedErrorResponse(
+			err.Error(),
+			CodeTooManyAttempts,
+		))
+		return
+	case attendance.ErrSessionClosed:
+		c.JSON(http.StatusUnprocessableEntity, codedErrorResponse(
+			err.Error(),
+			CodeSessionClosed,
 		))
 		return
-	} else if activityID == "" {
+	case attendance.ErrUnknownCode:
 		c.JSON(http.StatusUnprocessableEntity, codedErrorResponse(
 			"Activity id not found",
 			CodeNotFound,
 		))
 		return
+	default:
+		logrus.Errorf("Failed to read activity ID from redis: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"unable to retrieve activity data from db",
+			CodeRedisError,
+		))
+		return
 	}
 
 	//Check if user already participation
-	pString := fmt.Sprintf("participation-%s-%s", activityID, person.Email)
-	val, err := s.Redis.GetValue(pString)
+	repo := s.repo(c.Request.Context())
+	val, err := repo.Participation(activityID, person.Email)
 	if err != nil {
 		logrus.Errorf("Participation register get error: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
@@ -160,7 +172,7 @@ func (s *Server) registerParticipation(c *gin.Context) {
 		))
 		return
 	} else if val != nil {
-		logrus.Debugf("Event was already registered: %s", pString)
+		logrus.Debugf("Event was already registered: %s %s", activityID, person.Email)
 		c.JSON(http.StatusBadRequest, codedErrorResponse(
 			"already registered",
 			CodeAlreadyRegistered,
@@ -168,8 +180,33 @@ func (s *Server) registerParticipation(c *gin.Context) {
 		return
 	}
 
+	location, err := s.RPC.EventLocation(activityID)
+	if err != nil {
+		logrus.Warnf("Failed to get location of activity '%s': %s", activityID, err.Error())
+	}
+
+	p := s.Geofence.check(c, location)
+	if !p.Verified && s.Geofence.Unverified == PolicyReject {
+		logrus.Infof("Rejected participation of '%s' in '%s' from %s", person.Email, activityID, p.IP)
+		c.JSON(http.StatusForbidden, codedErrorResponse(
+			"not at the location of the activity",
+			CodeOutsideGeofence,
+		))
+		return
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		logrus.Errorf("Failed to marshal participation: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to register participation in db",
+			CodeInternalErrorGeneral,
+		))
+		return
+	}
+
 	//If not, register participation
-	err = s.Redis.WriteValue(pString, time.Now().String())
+	err = repo.SaveParticipation(activityID, person.Email, data)
 	if err != nil {
 		logrus.Errorf("Participation register write error: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
@@ -179,5 +216,6 @@ func (s *Server) registerParticipation(c *gin.Context) {
 		return
 	}
 
+	s.publishRegistration(c.Request.Context(), activityID, person.Email, p)
 	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+)
+
+const (
+	//PolicyPresent - unverified participants count as present
+	PolicyPresent = "present"
+	//PolicyAbsent - unverified participants count as absent by the absentee sync
+	PolicyAbsent = "absent"
+	//PolicyReject - participants that cannot be verified may not register
+	PolicyReject = "reject"
+
+	earthRadius = 6371000.0
+)
+
+//Fence - where participants must be for their participation to be verified
+type Fence struct {
+	//CIDRs are the networks participants may register from.
+	CIDRs []string `yaml:"cidrs"`
+
+	//Latitude and Longitude are the center of the area participants may report
+	//being within, and Radius its size in meters.
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	Radius    float64 `yaml:"radius"`
+
+	networks []*net.IPNet
+}
+
+//Geofence - checks where participants register attendance from
+type Geofence struct {
+	//Fences by the location or room of events, as sent by FlyVo.
+	Fences map[string]*Fence `yaml:"fences"`
+
+	//Default fence for events whose location has no fence.
+	Default *Fence `yaml:"default"`
+
+	//Unverified is what to do with participation that could not be verified,
+	//'present' (default), 'absent' or 'reject'.
+	Unverified string `yaml:"unverified"`
+}
+
+//participation - stored for each participant registered at an activity
+type participation struct {
+	Registered time.Time `json:"registered"`
+	Verified   bool      `json:"verified"`
+	IP         string    `json:"ip,omitempty"`
+	Latitude   *float64  `json:"latitude,omitempty"`
+	Longitude  *float64  `json:"longitude,omitempty"`
+}
+
+func (g *Geofence) init() error {
+	switch g.Unverified {
+	case "":
+		g.Unverified = PolicyPresent
+	case PolicyPresent, PolicyAbsent, PolicyReject:
+	default:
+		return fmt.Errorf("unknown geofence policy '%s'", g.Unverified)
+	}
+
+	fences := []*Fence{g.Default}
+	for _, fence := range g.Fences {
+		fences = append(fences, fence)
+	}
+
+	for _, fence := range fences {
+		if fence == nil {
+			continue
+		}
+		for _, cidr := range fence.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("bad geofence cidr '%s': %s", cidr, err.Error())
+			}
+			fence.networks = append(fence.networks, network)
+		}
+	}
+	return nil
+}
+
+//fence returns the fence of the location, preferring the room, or nil if the
+//location has none.
+func (g *Geofence) fence(location *flyvorpc.EventLocation) *Fence {
+	if location != nil {
+		if fence, ok := g.Fences[location.Room]; ok && location.Room != "" {
+			return fence
+		}
+		if fence, ok := g.Fences[location.Location]; ok && location.Location != "" {
+			return fence
+		}
+	}
+	return g.Default
+}
+
+//check records where the participant registers from, and whether it is within
+//the fence of the location. Participation at locations without a fence counts
+//as verified.
+func (g *Geofence) check(c *gin.Context, location *flyvorpc.EventLocation) participation {
+	p := participation{
+		Registered: time.Now(),
+		IP:         c.ClientIP(),
+	}
+
+	lat, latErr := strconv.ParseFloat(c.Query("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(c.Query("lon"), 64)
+	hasPosition := latErr == nil && lonErr == nil
+	if hasPosition {
+		p.Latitude, p.Longitude = &lat, &lon
+	}
+
+	fence := g.fence(location)
+	if fence == nil {
+		p.Verified = true
+		return p
+	}
+
+	ip := net.ParseIP(p.IP)
+	for _, network := range fence.networks {
+		if ip != nil && network.Contains(ip) {
+			p.Verified = true
+			return p
+		}
+	}
+
+	if hasPosition && fence.Radius > 0 {
+		//A position of unknown accuracy could be anywhere, so it is not verified
+		accuracy, err := strconv.ParseFloat(c.Query("accuracy"), 64)
+		distance := distance(lat, lon, fence.Latitude, fence.Longitude)
+		p.Verified = err == nil && accuracy >= 0 &&
+			distance <= fence.Radius && accuracy <= fence.Radius
+	}
+
+	if !p.Verified {
+		logrus.Debugf("Participation from %s not within fence", p.IP)
+	}
+	return p
+}
+
+//parseParticipation reads a stored participation. Participation stored before
+//it was checked counts as verified.
+func parseParticipation(stored []byte) participation {
+	p := participation{}
+	err := json.Unmarshal(stored, &p)
+	if err != nil {
+		return participation{Verified: true}
+	}
+	return p
+}
+
+//countsAsPresent returns whether the stored participation counts as present.
+func (g *Geofence) countsAsPresent(stored []byte) bool {
+	if g.Unverified != PolicyAbsent {
+		return true
+	}
+	return parseParticipation(stored).Verified
+}
+
+//distance returns the great-circle distance in meters between two positions.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
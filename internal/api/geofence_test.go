@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+)
+
+func TestGeofenceCheckPosition(t *testing.T) {
+	g := &Geofence{
+		Fences: map[string]*Fence{
+			"campus": {Latitude: 59.9139, Longitude: 10.7522, Radius: 200},
+		},
+	}
+	err := g.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := &flyvorpc.EventLocation{Location: "campus"}
+
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"within, accurate", "lat=59.9140&lon=10.7523&accuracy=20", true},
+		{"within, accuracy of radius", "lat=59.9140&lon=10.7523&accuracy=200", true},
+		{"within, inaccurate", "lat=59.9140&lon=10.7523&accuracy=500", false},
+		{"within, no accuracy", "lat=59.9140&lon=10.7523", false},
+		{"within, bad accuracy", "lat=59.9140&lon=10.7523&accuracy=good", false},
+		{"within, negative accuracy", "lat=59.9140&lon=10.7523&accuracy=-1", false},
+		{"within, NaN accuracy", "lat=59.9140&lon=10.7523&accuracy=NaN", false},
+		{"outside", "lat=59.95&lon=10.7522&accuracy=10", false},
+		{"no position", "", false},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/event/participate?"+test.query, nil)
+		c.Request.RemoteAddr = "192.0.2.1:1234"
+
+		if got := g.check(c, location).Verified; got != test.want {
+			t.Errorf("%s: verified %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	calendarCheckTimeout = 3 * time.Second
+)
+
+//checkReachable returns a check of whether the service at url responds
+//without a server error.
+func checkReachable(url string) func() error {
+	client := &http.Client{Timeout: calendarCheckTimeout}
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+//addHealthChecks registers the components the api needs to serve requests.
+//A missing flyvo client only degrades the api, as requests are then queued or
+//rejected at once.
+func (s *Server) addHealthChecks() {
+	s.Health.AddCheck(s.Storage.Name(), s.store.Ping)
+	s.Health.AddCheck("grpc", s.RPC.CheckListener)
+	s.Health.AddCheck("directory", s.Trovo.CheckCredentials)
+	if s.GcalURL != "" {
+		s.Health.AddCheck("calendar", checkReachable(s.GcalURL))
+	}
+	if s.RPC.Gcal != "" && s.RPC.Gcal != s.GcalURL {
+		s.Health.AddCheck("calendarQueue", checkReachable(s.RPC.Gcal))
+	}
+	s.Health.AddOptionalCheck("flyvoClient", s.RPC.CheckClient)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/tktip/flyvo-api/internal/storage"
+	"github.com/tktip/flyvo-api/pkg/healthcheck"
+)
+
+func TestReadyBeforeRPCInit(t *testing.T) {
+	s := &Server{}
+	s.Storage.Backend = storage.BackendFile
+	s.Storage.File.Path = filepath.Join(t.TempDir(), "state.json")
+	err := s.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addHealthChecks()
+
+	rec := httptest.NewRecorder()
+	s.Health.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	report := healthcheck.Report{}
+	err = json.Unmarshal(rec.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		storage.BackendFile: healthcheck.StatusOK,
+		"grpc":              healthcheck.StatusFailing,
+		"flyvoClient":       healthcheck.StatusFailing,
+	} {
+		if got := report.Components[name].Status; got != want {
+			t.Errorf("%s: got status %q, want %q", name, got, want)
+		}
+	}
+}
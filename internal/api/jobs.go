@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+)
+
+//dropActivity deletes the activity, its participation and overrides.
+func (s *Server) dropActivity(activityID string) error {
+	err := s.repository.DeleteActivity(activityID)
+	if err != nil {
+		return err
+	}
+	return s.repository.DeleteOverrides(calendarid.Encode(activityID))
+}
+
+//cleanStaleKeys deletes participation and overrides of activities that no
+//longer have a session, and are not waiting for the absentee sync.
+func (s *Server) cleanStaleKeys() error {
+	activities, err := s.repository.Activities()
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	for _, activityID := range activities {
+		live[calendarid.Encode(activityID)] = true
+	}
+
+	outstanding, err := s.outstandingSyncs()
+	if err != nil {
+		return err
+	}
+	for _, a := range outstanding {
+		live[a.ActivityID] = true
+	}
+
+	activities, err = s.repository.KnownActivities()
+	if err != nil {
+		return err
+	}
+	overridden, err := s.repository.OverriddenActivities()
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for _, stale := range []struct {
+		ids        []string
+		calendarID func(id string) string
+		delete     func(id string) error
+	}{
+		{activities, calendarid.Encode, s.repository.DeleteActivity},
+		{overridden, func(id string) string { return id }, s.repository.DeleteOverrides},
+	} {
+		for _, id := range stale.ids {
+			if live[stale.calendarID(id)] {
+				continue
+			}
+			err = stale.delete(id)
+			if err != nil {
+				return fmt.Errorf("failed to delete stale keys of '%s': %s", id, err.Error())
+			}
+			deleted++
+		}
+	}
+
+	logrus.Infof("Deleted stale keys of %d activities", deleted)
+	return nil
+}
+
+//reconcileCalendar drops the sessions, participation and overrides of
+//activities whose calendar event has been cancelled, so they are not synced.
+func (s *Server) reconcileCalendar() error {
+	activities, err := s.repository.Activities()
+	if err != nil {
+		return err
+	}
+
+	dropped, failed := 0, 0
+	for _, activityID := range activities {
+		event, err := s.getEvent(activityID)
+		if err != nil {
+			logrus.Errorf("Failed to get event '%s': %s", activityID, err.Error())
+			failed++
+			continue
+		} else if event == nil || event.Status != "cancelled" {
+			continue
+		}
+
+		logrus.Infof("Event of activity '%s' is cancelled, dropping it", activityID)
+		err = s.dropActivity(activityID)
+		if err != nil {
+			logrus.Errorf("Failed to drop activity '%s': %s", activityID, err.Error())
+			failed++
+			continue
+		}
+		dropped++
+	}
+
+	logrus.Infof("Dropped %d activities with cancelled events", dropped)
+	if failed > 0 {
+		return fmt.Errorf("%d activities could not be reconciled", failed)
+	}
+	return nil
+}
+
+//warmTeacherCache resolves and caches the roles of every member of the teacher
+//groups, so their first requests do not wait for the directory.
+func (s *Server) warmTeacherCache() error {
+	groups := s.roleGroups(RoleTeacher)
+	if len(groups) == 0 {
+		return errors.New("no teacher groups configured")
+	}
+
+	warmed := map[string]bool{}
+	failed := 0
+	for _, group := range groups {
+		members, err := s.Trovo.GroupMembers(group)
+		if err != nil {
+			return fmt.Errorf("failed to list members of '%s': %s", group, err.Error())
+		}
+
+		for _, email := range members {
+			if warmed[email] {
+				continue
+			}
+
+			err = s.repository.ForgetRoles(email)
+			if err == nil {
+				_, err = s.rolesOf(context.Background(), email)
+			}
+			if err != nil {
+				logrus.Warnf("Failed to resolve roles of '%s': %s", email, err.Error())
+				failed++
+				continue
+			}
+			warmed[email] = true
+		}
+	}
+
+	logrus.Infof("Cached roles of %d teachers", len(warmed))
+	if failed > 0 {
+		return fmt.Errorf("failed to resolve roles of %d teachers", failed)
+	}
+	return nil
+}
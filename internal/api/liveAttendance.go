@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//sseKeepAlive is how often an idle stream is pinged, so proxies keep it open.
+	sseKeepAlive = 15 * time.Second
+)
+
+//registration - a participant registered at an activity
+type registration struct {
+	ActivityID string    `json:"activityId"`
+	Email      string    `json:"email"`
+	Registered time.Time `json:"registered"`
+	Verified   bool      `json:"verified"`
+	Expected   bool      `json:"expected"`
+}
+
+//attendanceOverview - registered participants of an activity, compared with
+//the attendees of the calendar event
+type attendanceOverview struct {
+	ActivityID string         `json:"activityId"`
+	Expected   int            `json:"expected"`
+	Registered []registration `json:"registered"`
+	Missing    []string       `json:"missing"`
+}
+
+//registrations returns the participants registered at the activity.
+func (s *Server) registrations(ctx context.Context, activityID string) ([]registration, error) {
+	participations, err := s.repo(ctx).Participations(activityID)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make([]registration, 0, len(participations))
+	for _, entry := range participations {
+		p := parseParticipation(entry.Value)
+		registered = append(registered, registration{
+			ActivityID: activityID,
+			Email:      entry.Email,
+			Registered: p.Registered,
+			Verified:   p.Verified,
+		})
+	}
+
+	sort.Slice(registered, func(i, j int) bool {
+		return registered[i].Registered.Before(registered[j].Registered)
+	})
+	return registered, nil
+}
+
+//publishRegistration notifies teachers following the activity of a new
+//registration.
+func (s *Server) publishRegistration(
+	ctx context.Context,
+	activityID string,
+	email string,
+	p participation,
+) {
+	data, err := json.Marshal(registration{
+		ActivityID: activityID,
+		Email:      email,
+		Registered: p.Registered,
+		Verified:   p.Verified,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to marshal registration: %s", err.Error())
+		return
+	}
+
+	err = s.repo(ctx).PublishRegistration(activityID, data)
+	if err != nil {
+		logrus.Warnf("Failed to publish registration in '%s': %s", activityID, err.Error())
+	}
+}
+
+// getAttendance returns who has registered participation in an activity
+// @Summary Returns participants registered at an activity
+// @Description Returns the participants registered at an activity, with whether they are
+// @Description attendees of the calendar event, and the attendees that have not registered
+// @Produce application/json
+// @Param activityId path string true "id of an existing event"
+// @Success 200 {string} string "json attendance overview"
+// @Failure 403 {string} string "If unauthorized (not teacher or department admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis or calendar)"
+// @Router /attendance/{activityId} [GET]
+func (s *Server) getAttendance(c *gin.Context) {
+	activityID := c.Param("activityId")
+
+	registered, err := s.registrations(c.Request.Context(), activityID)
+	if err != nil {
+		logrus.Errorf("Failed to get registrations for '%s': %s", activityID, err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get registrations from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	event, err := s.getEvent(activityID)
+	if err != nil {
+		logrus.Errorf("Failed to get event '%s': %s", activityID, err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get event from calendar",
+			CodeConnectionError,
+		))
+		return
+	}
+
+	overview := attendanceOverview{
+		ActivityID: activityID,
+		Registered: registered,
+		Missing:    []string{},
+	}
+
+	expected := map[string]bool{}
+	if event != nil {
+		for _, attendee := range event.Attendees {
+			expected[strings.ToLower(attendee.Email)] = true
+		}
+	}
+	overview.Expected = len(expected)
+
+	present := map[string]bool{}
+	for i := range overview.Registered {
+		email := strings.ToLower(overview.Registered[i].Email)
+		overview.Registered[i].Expected = expected[email]
+		present[email] = true
+	}
+
+	for email := range expected {
+		if !present[email] {
+			overview.Missing = append(overview.Missing, email)
+		}
+	}
+	sort.Strings(overview.Missing)
+
+	c.JSON(http.StatusOK, overview)
+}
+
+// streamAttendance streams new registrations in an activity
+// @Summary Streams registrations in an activity
+// @Description Server-sent events with a 'registration' event for each participant registering
+// @Description at the activity, and a 'ping' event every 15 seconds while idle
+// @Produce text/event-stream
+// @Param activityId path string true "id of an existing event"
+// @Success 200 {string} string "event stream"
+// @Failure 403 {string} string "If unauthorized (not teacher in GCE)"
+// @Failure 500 {string} string "If unable to subscribe to registrations"
+// @Router /attendance/{activityId}/stream [GET]
+func (s *Server) streamAttendance(c *gin.Context) {
+	activityID := c.Param("activityId")
+
+	messages, stop, err := s.repo(c.Request.Context()).SubscribeRegistrations(activityID)
+	if err != nil {
+		logrus.Errorf("Failed to subscribe to registrations in '%s': %s", activityID, err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to subscribe to registrations",
+			CodeRedisError,
+		))
+		return
+	}
+	defer stop()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			c.SSEvent("registration", msg)
+		case <-ticker.C:
+			c.SSEvent("ping", time.Now().Unix())
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
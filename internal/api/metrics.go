@@ -0,0 +1,11 @@
+package api
+
+import "github.com/tktip/flyvo-api/pkg/metrics"
+
+var (
+	absenteeSyncRuns = metrics.NewCounter(
+		"flyvo_absentee_sync_runs_total",
+		"Attempts at registering absentees, per outcome.",
+		"outcome",
+	)
+)
@@ -0,0 +1,379 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+)
+
+const (
+	//StatusPresent - the participant counts as present
+	StatusPresent = "present"
+	//StatusAbsent - the participant is reported absent with the given absence code
+	StatusAbsent = "absent"
+	//StatusExcused - the participant is reported with the excused absence code, if any
+	StatusExcused = "excused"
+
+	defaultAbsenceCode = "U"
+)
+
+//AbsenceCodes - the codes absences are reported to FlyVo with
+type AbsenceCodes struct {
+	//Unauthorized is reported for participants that did not register. Defaults to 'U'.
+	Unauthorized string `yaml:"unauthorized"`
+
+	//Excused is reported for excused participants. If empty, they are not reported.
+	Excused string `yaml:"excused"`
+
+	//Valid are the codes teachers may report absences with. Defaults to any.
+	Valid []string `yaml:"valid"`
+}
+
+func (a *AbsenceCodes) init() {
+	if a.Unauthorized == "" {
+		a.Unauthorized = defaultAbsenceCode
+	}
+}
+
+func (a *AbsenceCodes) valid(code string) bool {
+	if len(a.Valid) == 0 || code == a.Unauthorized {
+		return true
+	}
+	for _, valid := range a.Valid {
+		if valid == code {
+			return true
+		}
+	}
+	return false
+}
+
+//code returns the absence code to report an absent participant with, or an
+//empty string if the absence is not to be reported.
+func (a *AbsenceCodes) code(o *override) string {
+	if o == nil {
+		return a.Unauthorized
+	}
+
+	switch o.Status {
+	case StatusExcused:
+		return a.Excused
+	case StatusAbsent:
+		if o.AbsenceCode != "" {
+			return o.AbsenceCode
+		}
+	}
+	return a.Unauthorized
+}
+
+//override - a teacher's correction of a participant's attendance, respected by
+//the absentee sync
+type override struct {
+	Email       string    `json:"email"`
+	Status      string    `json:"status"`
+	AbsenceCode string    `json:"absenceCode,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	By          string    `json:"by"`
+	At          time.Time `json:"at"`
+}
+
+//auditEntry - a change of an override
+type auditEntry struct {
+	At       time.Time `json:"at"`
+	By       string    `json:"by"`
+	Action   string    `json:"action"`
+	Email    string    `json:"email"`
+	Previous *override `json:"previous,omitempty"`
+	Current  *override `json:"current,omitempty"`
+}
+
+//overrides returns the overrides of the activity with @calendarID, by lower
+//case email.
+func (s *Server) overrides(ctx context.Context, calendarID string) (map[string]*override, error) {
+	entries, err := s.repo(ctx).Overrides(calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]*override{}
+	for _, entry := range entries {
+		o := &override{}
+		err = json.Unmarshal(entry.Value, o)
+		if err != nil {
+			return nil, fmt.Errorf("bad override of '%s': %s", entry.Email, err.Error())
+		}
+		overrides[strings.ToLower(o.Email)] = o
+	}
+	return overrides, nil
+}
+
+//audit records a change of an override. Failing to record it fails the change,
+//so every change is accounted for.
+func (s *Server) audit(ctx context.Context, calendarID string, entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Attendance override in '%s' by '%s': %s %s",
+		calendarID,
+		entry.By,
+		entry.Action,
+		entry.Email,
+	)
+	return s.repo(ctx).AppendAudit(calendarID, data)
+}
+
+//previousOverride returns the current override of the participant, if any.
+func (s *Server) previousOverride(
+	ctx context.Context,
+	calendarID string,
+	email string,
+) (*override, error) {
+	stored, err := s.repo(ctx).Override(calendarID, email)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	o := &override{}
+	err = json.Unmarshal(stored, o)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+//mayOverride checks that the person may correct the attendance of the activity:
+//department admins may correct any activity, teachers only those they have
+//opened an attendance session for. Responds and returns false if not.
+func (s *Server) mayOverride(c *gin.Context, activityID string, email string) bool {
+	if hasRole(getRoles(c), RoleDepartmentAdmin) {
+		return true
+	}
+
+	teaches, err := s.repo(c.Request.Context()).IsTeacher(activityID, email)
+	if err != nil {
+		logrus.Errorf("Failed to get teachers of '%s': %s", activityID, err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get teachers from db",
+			CodeRedisError,
+		))
+		return false
+	} else if !teaches {
+		c.JSON(http.StatusForbidden, codedErrorResponse(
+			"not a teacher of the activity",
+			CodeForbidden,
+		))
+		return false
+	}
+	return true
+}
+
+// getOverrides returns the attendance overrides of an activity
+// @Summary Returns attendance overrides
+// @Description Returns the attendance overrides teachers have made for an activity
+// @Produce application/json
+// @Param activityId path string true "id of an existing event"
+// @Success 200 {string} string "json list of overrides"
+// @Failure 403 {string} string "If unauthorized (not teacher or department admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /attendance/{activityId}/overrides [GET]
+func (s *Server) getOverrides(c *gin.Context) {
+	calendarID := calendarid.Encode(c.Param("activityId"))
+	overrides, err := s.overrides(c.Request.Context(), calendarID)
+	if err != nil {
+		logrus.Errorf("Failed to get overrides: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get overrides from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	list := make([]*override, 0, len(overrides))
+	for _, o := range overrides {
+		list = append(list, o)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// setOverride overrides the attendance of a participant
+// @Summary Override attendance
+// @Description Marks a participant as present, absent with an absence code, or excused,
+// @Description regardless of whether they registered. Respected by the absentee sync.
+// @Accept application/json
+// @Produce application/json
+// @Param activityId path string true "id of an existing event"
+// @Param email path string true "email of the participant"
+// @Param override body string true "{status: present/absent/excused, absenceCode, note}"
+// @Success 200 {string} string "json override"
+// @Failure 400 {string} string "If bad status or absence code"
+// @Failure 422 {string} string "If bad request body"
+// @Failure 403 {string} string "If unauthorized (not teacher of the activity or department admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /attendance/{activityId}/overrides/{email} [PUT]
+func (s *Server) setOverride(c *gin.Context) {
+	teacher, ok := getPersonObject(c)
+	if !ok || !s.mayOverride(c, c.Param("activityId"), teacher.Email) {
+		return
+	}
+
+	calendarID := calendarid.Encode(c.Param("activityId"))
+	email := strings.ToLower(c.Param("email"))
+
+	o := &override{}
+	err := c.ShouldBindJSON(o)
+	if err != nil {
+		logrus.Errorf("Failed to bind override: %s", err.Error())
+		c.JSON(http.StatusUnprocessableEntity, codedErrorResponse("bad request body",
+			CodeBadRequest,
+		))
+		return
+	}
+
+	switch o.Status {
+	case StatusPresent, StatusExcused:
+		o.AbsenceCode = ""
+	case StatusAbsent:
+		if !s.AbsenceCodes.valid(o.AbsenceCode) {
+			c.JSON(http.StatusBadRequest, codedErrorResponse(
+				fmt.Sprintf("absence code must be one of %v", s.AbsenceCodes.Valid),
+				CodeBadRequest,
+			))
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, codedErrorResponse(
+			"status must be present, absent or excused",
+			CodeBadRequest,
+		))
+		return
+	}
+	o.Email = email
+	o.By = teacher.Email
+	o.At = time.Now()
+
+	previous, err := s.previousOverride(c.Request.Context(), calendarID, email)
+	if err != nil {
+		logrus.Errorf("Failed to get override: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get override from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	data, err := json.Marshal(o)
+	if err == nil {
+		err = s.audit(c.Request.Context(), calendarID, auditEntry{
+			At:       o.At,
+			By:       o.By,
+			Action:   "set",
+			Email:    email,
+			Previous: previous,
+			Current:  o,
+		})
+	}
+	if err == nil {
+		err = s.repo(c.Request.Context()).SaveOverride(calendarID, email, data)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to store override: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to store override in db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	c.JSON(http.StatusOK, o)
+}
+
+// deleteOverride removes an attendance override
+// @Summary Remove attendance override
+// @Description Removes the override of a participant's attendance
+// @Param activityId path string true "id of an existing event"
+// @Param email path string true "email of the participant"
+// @Success 204 {string} string "If the override was removed"
+// @Failure 403 {string} string "If unauthorized (not teacher of the activity or department admin)"
+// @Failure 404 {string} string "If the participant has no override"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /attendance/{activityId}/overrides/{email} [DELETE]
+func (s *Server) deleteOverride(c *gin.Context) {
+	teacher, ok := getPersonObject(c)
+	if !ok || !s.mayOverride(c, c.Param("activityId"), teacher.Email) {
+		return
+	}
+
+	calendarID := calendarid.Encode(c.Param("activityId"))
+	email := strings.ToLower(c.Param("email"))
+
+	previous, err := s.previousOverride(c.Request.Context(), calendarID, email)
+	if err == nil && previous == nil {
+		c.JSON(http.StatusNotFound, codedErrorResponse("no override", CodeNotFound))
+		return
+	}
+
+	if err == nil {
+		err = s.audit(c.Request.Context(), calendarID, auditEntry{
+			At:       time.Now(),
+			By:       teacher.Email,
+			Action:   "remove",
+			Email:    email,
+			Previous: previous,
+		})
+	}
+	if err == nil {
+		err = s.repo(c.Request.Context()).DeleteOverride(calendarID, email)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to remove override: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to remove override from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getOverrideAudit returns the audit trail of attendance overrides
+// @Summary Returns audit trail of attendance overrides
+// @Description Returns who changed which overrides of an activity and when, newest first
+// @Produce application/json
+// @Param activityId path string true "id of an existing event"
+// @Success 200 {string} string "json list of audit entries"
+// @Failure 403 {string} string "If unauthorized (not teacher or department admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /attendance/{activityId}/audit [GET]
+func (s *Server) getOverrideAudit(c *gin.Context) {
+	calendarID := calendarid.Encode(c.Param("activityId"))
+	values, err := s.repo(c.Request.Context()).Audit(calendarID)
+	if err != nil {
+		logrus.Errorf("Failed to get audit trail: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get audit trail from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	entries := make([]auditEntry, 0, len(values))
+	for _, value := range values {
+		entry := auditEntry{}
+		err = json.Unmarshal([]byte(value), &entry)
+		if err != nil {
+			logrus.Warnf("Skipping bad audit entry: %s", err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tktip/flyvo-api/internal/storage"
+)
+
+func TestMayOverride(t *testing.T) {
+	s := &Server{}
+	s.Storage.Backend = storage.BackendFile
+	s.Storage.File.Path = filepath.Join(t.TempDir(), "state.json")
+	err := s.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.repository.AddTeacher("activity", "Kari@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		email string
+		roles []Role
+		want  int
+	}{
+		{"teacher of activity", "kari@example.com", []Role{RoleTeacher}, http.StatusOK},
+		{"other teacher", "ola@example.com", []Role{RoleTeacher}, http.StatusForbidden},
+		{"department admin", "per@example.com", []Role{RoleDepartmentAdmin}, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPut, "/", nil)
+		c.Set("roles", test.roles)
+
+		ok := s.mayOverride(c, "activity", test.email)
+		if ok != (test.want == http.StatusOK) || rec.Code != test.want {
+			t.Errorf("%s: got %v and status %d, want status %d", test.name, ok, rec.Code, test.want)
+		}
+	}
+}
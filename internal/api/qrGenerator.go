@@ -3,153 +3,250 @@ package api
 //revive:disable:line-length-limit
 
 import (
-	"io/ioutil"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/attendance"
+	"github.com/tktip/flyvo-api/pkg/qr"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	qrFormatPNG = "png"
+	qrFormatSVG = "svg"
+
+	defaultQrSize = 256
+	minQrSize     = 64
+	maxQrSize     = 2048
+)
+
+//QRConfig - how QR codes are rendered
+type QRConfig struct {
+	//Size is the default width of QR code images, in pixels. Defaults to 256.
+	Size int `yaml:"size"`
+
+	//Level is the default error correction level, L, M, Q or H. Defaults to M.
+	Level string `yaml:"level"`
+
+	level qr.Level
+}
+
+func (q *QRConfig) init() (err error) {
+	if q.Size == 0 {
+		q.Size = defaultQrSize
+	}
+	if q.Level == "" {
+		q.Level = "M"
+	}
+
+	q.level, err = qr.ParseLevel(q.Level)
+	return err
+}
+
+//size returns the requested image size, or the default if none is requested.
+func (q *QRConfig) size(requested string) (int, error) {
+	if requested == "" {
+		return q.Size, nil
+	}
+
+	size, err := strconv.Atoi(requested)
+	if err != nil || size < minQrSize || size > maxQrSize {
+		return 0, errors.New("size must be a number from " +
+			strconv.Itoa(minQrSize) + " to " + strconv.Itoa(maxQrSize))
+	}
+	return size, nil
+}
+
 // generateParticipationID generate participation ID for event
 // @Summary Generate participation ID for event
-// @Description Generates participation ID for event based on activity ID
+// @Description Opens an attendance session for the activity, unless one is open, and returns its current participation ID. The ID rotates, so it should be fetched again at 'rotatesAt'.
 // @Produce application/json
 // @Param activityId query string true "id of an existing event"
-// @Success 200 {string} string "A participation ID in a json structure: {'participationId':ID'} "
+// @Success 200 {string} string "A participation ID in a json structure: {'participationId':ID, 'rotatesAt':time, 'sessionExpires':time} "
 // @Failure 403 {string} string "If unauthorized (not teacher in GCE)"
 // @Failure 500 {string} string "On any other error"
 // @Router /generate/participationId [GET]
 func (s *Server) generateParticipationID(c *gin.Context) {
-
-	if !isTeacher(c) {
+	activityID := c.Query("activityId")
+	if activityID == "" {
+		c.JSON(http.StatusBadRequest, codedErrorResponse(
+			"missing activityId",
+			CodeBadRequest,
+		))
 		return
 	}
 
-	activityID := c.Query("activityId")
-
-	participationPIN := ""
-	counter := 0
-	numberOfRunes := 4
-	for {
-		participationPIN = randStringRunes(numberOfRunes)
-		response, err := s.Redis.GetValue(participationPIN)
-		if err != nil {
-			logrus.Errorf("Failed to get participation Id value from redis: %s", err.Error())
-			c.JSON(http.StatusInternalServerError, codedErrorResponse(
-				"failed to create PIN",
-				CodeRedisError,
-			))
-			return
-		}
+	code, ok := s.openSession(c, activityID)
+	if !ok {
+		return
+	}
 
-		if response == nil {
-			break
-		}
+	c.JSON(http.StatusOK, code)
+}
 
-		if counter == 10000 {
-			numberOfRunes++
-			counter = 0
-		}
-		counter = counter + 1
+//openSession opens the attendance session of the activity, unless one is open,
+//and returns its current code.
+func (s *Server) openSession(c *gin.Context, activityID string) (attendance.Code, bool) {
+	person, ok := getPersonObject(c)
+	if !ok {
+		return attendance.Code{}, false
 	}
 
-	err := s.Redis.WriteValue(participationPIN, activityID)
+	code, err := s.Attendance.Open(activityID, person.Email)
 	if err != nil {
-		logrus.Errorf("Failed to write participation Id activity ID pair to redis: %s", err.Error())
+		logrus.Errorf("Failed to open attendance session for '%s': %s", activityID, err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
 			"failed to create PIN",
 			CodeRedisError,
 		))
-		return
+		return attendance.Code{}, false
 	}
 
-	err = s.Redis.WriteValue("activity-"+activityID, activityID)
+	err = s.repo(c.Request.Context()).AddActivity(activityID)
+	if err == nil {
+		err = s.repo(c.Request.Context()).AddTeacher(activityID, person.Email)
+	}
 	if err != nil {
 		logrus.Errorf("Failed to register activity '%s' as having occurred: %s ", activityID, err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
 			"failed to register activity",
 			CodeRedisError,
 		))
+		return attendance.Code{}, false
+	}
+
+	return code, true
+}
+
+// closeSession closes the attendance session of an event
+// @Summary Close attendance session
+// @Description Closes the attendance session of an activity. Its participation IDs are no longer accepted.
+// @Param activityId query string true "id of an existing event"
+// @Success 204 {string} string "If the session was closed"
+// @Failure 403 {string} string "If unauthorized (not teacher in GCE)"
+// @Failure 404 {string} string "If the activity has no open session"
+// @Failure 500 {string} string "On any other error"
+// @Router /session/close [POST]
+func (s *Server) closeSession(c *gin.Context) {
+	person, ok := getPersonObject(c)
+	if !ok {
+		return
+	}
+
+	err := s.Attendance.Close(c.Query("activityId"), person.Email)
+	if err == attendance.ErrNoSession {
+		c.JSON(http.StatusNotFound, codedErrorResponse(
+			err.Error(),
+			CodeNotFound,
+		))
+		return
+	} else if err != nil {
+		logrus.Errorf("Failed to close attendance session: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to close session",
+			CodeRedisError,
+		))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"participationId": participationPIN,
-	})
+	c.Status(http.StatusNoContent)
 }
 
 // generateQrCode generate QR code based on participationId
 // @Summary Create QR code
-// @Description Generates a QR code image encoded in base64
-// @Produce application/json
+// @Description Generates a QR code linking to the participant page with the participation ID, as PNG or SVG
+// @Produce image/png
+// @Produce image/svg+xml
 // @Param participationId query string true "id displayed to participants in physical form and QR code"
-// @Success 200 {string} string "A base 64 encoded image of QR code"
+// @Param format query string false "png (default) or svg"
+// @Param size query int false "width of the image in pixels"
+// @Param level query string false "error correction level, L, M, Q or H"
+// @Success 200 {string} string "The QR code image"
+// @Failure 400 {string} string "If bad format, size or level"
 // @Failure 403 {string} string "If unauthorized (not teacher in GCE)"
 // @Failure 422 {string} string "If participation ID not found"
 // @Failure 500 {string} string "On any unexpected error (e.g. unable to connect to Redis)"
-// @Router /generateQrCode [GET]
+// @Router /generate/qr [GET]
 func (s *Server) generateQrCode(c *gin.Context) {
 	participationID := c.Query("participationId")
 
-	if !isTeacher(c) {
+	_, err := s.Attendance.Validate(participationID)
+	if err == attendance.ErrUnknownCode || err == attendance.ErrSessionClosed {
+		logrus.Debugf("No open session for id '%s'", participationID)
+		c.JSON(http.StatusUnprocessableEntity, codedErrorResponse(
+			"No activity mapped to that ID",
+			CodeNotFound,
+		))
 		return
-	}
-
-	client := &http.Client{}
-
-	activityID, err := s.Redis.GetValue(participationID)
-	if err != nil {
+	} else if err != nil {
 		logrus.Errorf("Failed to retrieve activity ID from redis: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
 			"Failed to get activity from db",
 			CodeRedisError,
 		))
 		return
-	} else if activityID == nil {
-		logrus.Debugf("No activity mapped to id '%s'", participationID)
-		c.JSON(http.StatusUnprocessableEntity, codedErrorResponse(
-			"No activity mapped to that ID",
-			CodeNotFound,
-		))
-		return
 	}
 
-	req, err := http.NewRequest("GET", s.QrURL, nil)
+	size, err := s.QR.size(c.Query("size"))
 	if err != nil {
-		logrus.Errorf("Failed to create qr code request: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, codedErrorResponse(
-			"Unable to generate QR code",
-			CodeQRError,
-		))
+		c.JSON(http.StatusBadRequest, codedErrorResponse(err.Error(), CodeBadRequest))
 		return
 	}
 
-	q := req.URL.Query()
-	q.Add("data", s.ParticipantURL+"?id="+participationID)
-	req.URL.RawQuery = q.Encode()
+	code, ok := s.participantQrCode(c, participationID)
+	if !ok {
+		return
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logrus.Errorf("Failed to retrieve qr code: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, codedErrorResponse(
-			"Failed to retrieve QR code",
-			CodeQRError,
+	switch c.DefaultQuery("format", qrFormatPNG) {
+	case qrFormatPNG:
+		image, err := code.PNG(size)
+		if err != nil {
+			logrus.Errorf("Failed to render qr code: %s", err.Error())
+			c.JSON(http.StatusInternalServerError, codedErrorResponse(
+				"Unable to generate QR code",
+				CodeQRError,
+			))
+			return
+		}
+		c.Data(http.StatusOK, "image/png", image)
+	case qrFormatSVG:
+		c.Data(http.StatusOK, "image/svg+xml", []byte(code.SVG(size)))
+	default:
+		c.JSON(http.StatusBadRequest, codedErrorResponse(
+			"format must be png or svg",
+			CodeBadRequest,
 		))
-		return
 	}
-	defer resp.Body.Close()
+}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+//participantQrCode encodes the link participants register with, at the error
+//correction level requested or configured.
+func (s *Server) participantQrCode(c *gin.Context, participationID string) (*qr.Code, bool) {
+	level := s.QR.level
+	if l := c.Query("level"); l != "" {
+		var err error
+		level, err = qr.ParseLevel(l)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, codedErrorResponse(
+				"level must be L, M, Q or H",
+				CodeBadRequest,
+			))
+			return nil, false
+		}
+	}
+
+	code, err := qr.Encode(s.ParticipantURL+"?id="+participationID, level)
 	if err != nil {
-		logrus.Errorf("Failed to read qr code response: %s", err.Error())
+		logrus.Errorf("Failed to encode qr code: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, codedErrorResponse(
-			"Failed to retrieve QR code",
+			"Unable to generate QR code",
 			CodeQRError,
 		))
-		return
+		return nil, false
 	}
-
-	// logrus.Info(string(bytes))
-	c.Data(http.StatusOK, resp.Header.Get("content-type"), bytes)
+	return code, true
 }
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//Role - a role a user may have, granted by membership in google groups
+type Role string
+
+const (
+	//RoleStudent - participates in activities
+	RoleStudent Role = "student"
+
+	//RoleTeacher - holds activities
+	RoleTeacher Role = "teacher"
+
+	//RoleDepartmentAdmin - administers a department
+	RoleDepartmentAdmin Role = "departmentAdmin"
+
+	//RoleSystemAdmin - administers flyvo-api
+	RoleSystemAdmin Role = "systemAdmin"
+)
+
+var (
+	allRoles = []Role{RoleStudent, RoleTeacher, RoleDepartmentAdmin, RoleSystemAdmin}
+)
+
+//roleGroups returns the google groups granting role. Students are everyone,
+//unless student groups are configured, and teachers default to the trovo
+//teacher group.
+func (s *Server) roleGroups(role Role) []string {
+	groups := s.Roles[role]
+	if len(groups) == 0 && role == RoleTeacher && s.Trovo.TeacherGroup != "" {
+		return []string{s.Trovo.TeacherGroup}
+	}
+	return groups
+}
+
+//rolesOf returns the roles of the user with email, cached in redis.
+//revive:disable-next-line:cyclomatic
+func (s *Server) rolesOf(ctx context.Context, email string) (roles []Role, err error) {
+	if email == "" {
+		return nil, errors.New("no email")
+	}
+
+	cached, err := s.repo(ctx).CachedRoles(email)
+	if err != nil {
+		return nil, err
+	} else if cached != nil {
+		err = json.Unmarshal(cached, &roles)
+		if err == nil {
+			return roles, nil
+		}
+		logrus.Warnf("Bad cached roles for '%s': %s", email, err.Error())
+	}
+
+	roles = []Role{}
+	for _, role := range allRoles {
+		groups := s.roleGroups(role)
+		if len(groups) == 0 && role == RoleStudent {
+			roles = append(roles, role)
+			continue
+		}
+
+		for _, group := range groups {
+			var member bool
+			member, err = s.Trovo.IsMemberOf(group, email)
+			if err != nil {
+				return nil, err
+			}
+			if member {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+
+	data, err := json.Marshal(roles)
+	if err != nil {
+		return nil, err
+	}
+
+	//Disregarding this error as it won't cause any issues.
+	err = s.repo(ctx).CacheRoles(email, data, teacherTimeout)
+	if err != nil {
+		logrus.Errorf("Failed to write value to redis: %s", err.Error())
+	}
+
+	return roles, nil
+}
+
+//setRoles resolves the roles of the person making the request.
+func (s *Server) setRoles(c *gin.Context) {
+	var roles []Role
+	if s.Auth.DevImpersonation.Enabled {
+		roles = s.Auth.impersonatedRoles()
+	} else {
+		p, ok := getPersonObject(c)
+		if !ok {
+			logrus.Error("Reached setRoles without person set.")
+			return
+		}
+
+		var err error
+		roles, err = s.rolesOf(c.Request.Context(), p.Email)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error":     err.Error(),
+				"errorCode": CodeInternalErrorGeneral,
+			})
+			return
+		}
+	}
+
+	c.Set("roles", roles)
+	c.Set("teacher", hasRole(roles, RoleTeacher))
+	c.Next()
+}
+
+func hasRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func getRoles(c *gin.Context) []Role {
+	roles, ok := c.Get("roles")
+	if !ok {
+		return nil
+	}
+	return roles.([]Role)
+}
+
+//requireRole returns a middleware rejecting requests from users that have
+//none of the given roles.
+func requireRole(roles ...Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		has := getRoles(c)
+		for _, role := range roles {
+			if hasRole(has, role) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden,
+			codedErrorResponse(
+				"insufficient privileges",
+				CodeForbidden,
+			))
+	}
+}
+
+// getUserRoles returns the roles of the user
+// @Summary Returns the roles of the user
+// @Description Returns the roles granted to the user,
+// @Description e.g. student, teacher, departmentAdmin, systemAdmin
+// @Produce application/json
+// @Success 200 {string} string "json list of roles"
+// @Router /roles [GET]
+func (s *Server) getUserRoles(c *gin.Context) {
+	c.JSON(http.StatusOK, getRoles(c))
+}
@@ -0,0 +1,315 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+)
+
+const (
+	//JobAbsenteeSync - registers absentees at FlyVo
+	JobAbsenteeSync = "absenteeSync"
+	//JobStaleKeyCleanup - deletes participation and overrides of activities that are gone
+	JobStaleKeyCleanup = "staleKeyCleanup"
+	//JobCalendarReconciliation - drops activities whose calendar event is cancelled
+	JobCalendarReconciliation = "calendarReconciliation"
+	//JobTeacherCacheWarmup - resolves the roles of all teachers ahead of their requests
+	JobTeacherCacheWarmup = "teacherCacheWarmup"
+)
+
+var (
+	//ErrJobRunning - the job is already running
+	ErrJobRunning = errors.New("job already running")
+
+	//ErrUnknownJob - no job has the name
+	ErrUnknownJob = errors.New("unknown job")
+)
+
+//Job - when a job is run
+type Job struct {
+	//Cron is the schedule, with seconds, e.g. '0 0 2 * * *'.
+	Cron string `yaml:"cron"`
+
+	//TimeZone the schedule is in. Defaults to Europe/Oslo.
+	TimeZone string `yaml:"timeZone"`
+
+	//Jitter is the longest random delay before each scheduled run.
+	Jitter time.Duration `yaml:"jitter"`
+
+	//Enabled decides whether the job runs on schedule. Defaults to true if it
+	//has a schedule.
+	Enabled *bool `yaml:"enabled"`
+}
+
+//jobStatus - a job and its runs, as shown to admins
+type jobStatus struct {
+	Name        string     `json:"name"`
+	Enabled     bool       `json:"enabled"`
+	Cron        string     `json:"cron,omitempty"`
+	TimeZone    string     `json:"timeZone,omitempty"`
+	Jitter      string     `json:"jitter,omitempty"`
+	Running     bool       `json:"running"`
+	LastStarted *time.Time `json:"lastStarted,omitempty"`
+	LastEnded   *time.Time `json:"lastEnded,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Next        *time.Time `json:"next,omitempty"`
+}
+
+//job - a registered job
+type job struct {
+	name     string
+	run      func() error
+	config   Job
+	schedule cron.Schedule
+	location *time.Location
+
+	running     bool
+	lastStarted *time.Time
+	lastEnded   *time.Time
+	lastError   string
+	next        *time.Time
+}
+
+func (j *job) enabled() bool {
+	return j.schedule != nil && (j.config.Enabled == nil || *j.config.Enabled)
+}
+
+//scheduler - runs jobs on their schedules, or when triggered
+type scheduler struct {
+	lock sync.Mutex
+	jobs map[string]*job
+}
+
+//register adds a job, parsing its schedule.
+func (sc *scheduler) register(name string, config Job, run func() error) error {
+	j := &job{
+		name:   name,
+		run:    run,
+		config: config,
+	}
+
+	if config.Cron != "" {
+		var err error
+		j.schedule, err = cron.Parse(config.Cron)
+		if err != nil {
+			return fmt.Errorf("bad cron string for job '%s': %s", name, err.Error())
+		}
+		j.location, err = flyvorpc.LoadTimeZone(config.TimeZone)
+		if err != nil {
+			return fmt.Errorf("bad time zone for job '%s': %s", name, err.Error())
+		}
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.jobs == nil {
+		sc.jobs = map[string]*job{}
+	}
+	sc.jobs[name] = j
+	return nil
+}
+
+//start runs the enabled jobs on their schedules.
+func (sc *scheduler) start() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for _, j := range sc.jobs {
+		if !j.enabled() {
+			logrus.Infof("Job '%s' is not scheduled", j.name)
+			continue
+		}
+		logrus.Infof("Scheduling job '%s' with '%s' (%s)", j.name, j.config.Cron, j.location)
+		go sc.loop(j)
+	}
+}
+
+//loop runs the job each time it is due.
+func (sc *scheduler) loop(j *job) {
+	for {
+		next := j.schedule.Next(time.Now().In(j.location))
+		if j.config.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.config.Jitter))))
+		}
+
+		sc.lock.Lock()
+		j.next = &next
+		sc.lock.Unlock()
+
+		time.Sleep(time.Until(next))
+		if !sc.begin(j) {
+			logrus.Warnf("Skipping job '%s', the previous run has not finished", j.name)
+			continue
+		}
+		_ = sc.execute(j)
+	}
+}
+
+//trigger runs the job in the background.
+func (sc *scheduler) trigger(name string) error {
+	sc.lock.Lock()
+	j, ok := sc.jobs[name]
+	sc.lock.Unlock()
+
+	if !ok {
+		return ErrUnknownJob
+	} else if !sc.begin(j) {
+		return ErrJobRunning
+	}
+
+	go func() {
+		_ = sc.execute(j)
+	}()
+	return nil
+}
+
+//begin marks the job as running, unless it already is.
+func (sc *scheduler) begin(j *job) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if j.running {
+		return false
+	}
+
+	started := time.Now()
+	j.running = true
+	j.lastStarted = &started
+	return true
+}
+
+//execute runs a job marked as running, and records the outcome.
+func (sc *scheduler) execute(j *job) error {
+	logrus.Infof("Running job '%s'", j.name)
+	err := j.run()
+	ended := time.Now()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if err != nil {
+		logrus.Errorf("Job '%s' failed: %s", j.name, err.Error())
+	} else {
+		logrus.Infof("Job '%s' done in %s", j.name, ended.Sub(*j.lastStarted))
+	}
+
+	j.running = false
+	j.lastEnded = &ended
+	j.lastError = ""
+	if err != nil {
+		j.lastError = err.Error()
+	}
+	return err
+}
+
+//status returns the jobs, by name.
+func (sc *scheduler) status() []jobStatus {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	statuses := []jobStatus{}
+	for _, j := range sc.jobs {
+		status := jobStatus{
+			Name:        j.name,
+			Enabled:     j.enabled(),
+			Cron:        j.config.Cron,
+			Running:     j.running,
+			LastStarted: j.lastStarted,
+			LastEnded:   j.lastEnded,
+			LastError:   j.lastError,
+		}
+		if j.location != nil {
+			status.TimeZone = j.location.String()
+		}
+		if j.config.Jitter > 0 {
+			status.Jitter = j.config.Jitter.String()
+		}
+		if status.Enabled {
+			status.Next = j.next
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+//startJobs registers the jobs of the api and runs them on their schedules.
+//The absentee sync falls back to absentCron if it has no job config.
+func (s *Server) startJobs() error {
+	jobs := map[string]func() error{
+		JobAbsenteeSync:           s.absenteeCronJob,
+		JobStaleKeyCleanup:        s.cleanStaleKeys,
+		JobCalendarReconciliation: s.reconcileCalendar,
+		JobTeacherCacheWarmup:     s.warmTeacherCache,
+	}
+
+	for name := range s.Jobs {
+		if jobs[name] == nil {
+			return fmt.Errorf("unknown job '%s'", name)
+		}
+	}
+
+	for name, run := range jobs {
+		config := Job{}
+		if s.Jobs[name] != nil {
+			config = *s.Jobs[name]
+		} else if name == JobAbsenteeSync {
+			config.Cron = s.AbsenteeCronString
+		}
+
+		err := s.scheduler.register(name, config, run)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.scheduler.start()
+	return nil
+}
+
+// getJobs returns the scheduled jobs
+// @Summary Returns jobs
+// @Description Returns the jobs of the api, with their schedules, last and next runs
+// @Produce application/json
+// @Success 200 {string} string "json list of jobs"
+// @Failure 403 {string} string "If unauthorized (not system admin)"
+// @Router /jobs [GET]
+func (s *Server) getJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, s.scheduler.status())
+}
+
+// runJob triggers a job
+// @Summary Runs a job
+// @Description Runs a job in the background now, whether it is scheduled or not
+// @Param name path string true "name of the job"
+// @Success 202 {string} string "If the job was started"
+// @Failure 403 {string} string "If unauthorized (not system admin)"
+// @Failure 404 {string} string "If there is no such job"
+// @Failure 409 {string} string "If the job is already running"
+// @Router /jobs/{name}/run [POST]
+func (s *Server) runJob(c *gin.Context) {
+	err := s.scheduler.trigger(c.Param("name"))
+	switch err {
+	case nil:
+		c.Status(http.StatusAccepted)
+	case ErrUnknownJob:
+		c.JSON(http.StatusNotFound, codedErrorResponse(err.Error(), CodeNotFound))
+	case ErrJobRunning:
+		c.JSON(http.StatusConflict, codedErrorResponse(err.Error(), CodeBadRequest))
+	default:
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			err.Error(),
+			CodeInternalErrorGeneral,
+		))
+	}
+}
@@ -2,14 +2,19 @@ package api
 
 import (
 	"context"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/attendance"
 	"github.com/tktip/flyvo-api/internal/flyvo/rpc"
 	"github.com/tktip/flyvo-api/internal/googletrovo"
+	"github.com/tktip/flyvo-api/internal/identity"
 	"github.com/tktip/flyvo-api/internal/redis"
+	"github.com/tktip/flyvo-api/internal/repository"
+	"github.com/tktip/flyvo-api/internal/storage"
+	"github.com/tktip/flyvo-api/pkg/healthcheck"
 	"github.com/tktip/flyvo-api/pkg/swagex"
-	//	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,51 +29,158 @@ type Server struct {
 	Redis redis.Connector       `yaml:"redis"`
 	RPC   rpc.Server            `yaml:"rpc"`
 	Trovo googletrovo.Connector `yaml:"trovo"`
+	Auth  Auth                  `yaml:"auth"`
 
-	GcalURL string `yaml:"gcalUrl"`
-	QrURL   string `yaml:"qrUrl"`
+	//Storage is where state is kept. Defaults to redis.
+	Storage storage.Config `yaml:"storage"`
+
+	Health healthcheck.Service `yaml:"health"`
+
+	Identity identity.Mapper `yaml:"identity"`
+
+	Attendance attendance.Sessions `yaml:"attendance"`
+	Geofence   Geofence            `yaml:"geofence"`
+
+	AbsenceCodes AbsenceCodes `yaml:"absenceCodes"`
+
+	//TrustedProxies are the networks trusted to forward the client address in
+	//X-Forwarded-For. Defaults to none, so the address of the connection is used.
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	//Roles maps roles to the google groups granting them.
+	Roles map[Role][]string `yaml:"roles"`
+
+	GcalURL string   `yaml:"gcalUrl"`
+	QR      QRConfig `yaml:"qr"`
 
 	ParticipantURL string `yaml:"participantUrl"`
 
-	AbsenteeCronString string `yaml:"absentCron"`
+	AbsenteeCronString string       `yaml:"absentCron"`
+	AbsenteeSync       AbsenteeSync `yaml:"absenteeSync"`
+
+	//Jobs configures the scheduled jobs by name.
+	Jobs map[string]*Job `yaml:"jobs"`
+
+	store      storage.Store
+	repository *repository.Repository
+	syncLock   sync.Mutex
+	scheduler  scheduler
+}
+
+//openStore opens the configured storage, and the repository on top of it.
+func (s *Server) openStore() error {
+	store, err := s.Storage.Open(&s.Redis)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	s.repository = repository.New(store)
+	return nil
+}
+
+//repo returns the repository, with calls failing once @ctx is done.
+func (s *Server) repo(ctx context.Context) *repository.Repository {
+	return s.repository.WithContext(ctx)
 }
 
 //Run starts the api
 func (s *Server) Run() error {
+	err := s.openStore()
+	if err != nil {
+		return err
+	}
+
+	s.addHealthChecks()
+	go s.Health.Start()
+
+	err = s.Auth.init()
+	if err != nil {
+		return err
+	}
+
+	err = s.QR.init()
+	if err != nil {
+		return err
+	}
+
+	err = s.Geofence.init()
+	if err != nil {
+		return err
+	}
+
+	s.AbsenceCodes.init()
+	s.AbsenteeSync.init()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s.RPC.Redis = &s.Redis
+	s.RPC.Store = s.store
 
 	defer cancel()
 
+	//Index values written before the indexes were kept
+	err = s.repository.Reindex()
+	if err != nil {
+		logrus.Errorf("Failed to reindex storage: %s", err.Error())
+	}
+
+	err = s.Identity.Init(&s.Trovo)
+	if err != nil {
+		return err
+	}
+	s.RPC.Identity = &s.Identity
+	s.RPC.OnDelivered = s.absencesDelivered
+	s.Attendance.Init(s.store)
+
+	err = s.RPC.Init()
+	if err != nil {
+		return err
+	}
 	go s.RPC.Run(ctx)
 
-	if s.AbsenteeCronString != "" {
-		logrus.Infof("Starting absentee cron job (%s)", s.AbsenteeCronString)
-		err := s.startAbsenteeCronJob()
-		if err != nil {
-			return err
-		}
-	} else {
-		logrus.Warn("No cron string provided")
+	err = s.startJobs()
+	if err != nil {
+		return err
 	}
 
 	//Starting Gin
 	r := gin.New()
+	r.TrustedProxies = s.TrustedProxies
 	r.Use(gin.Logger()) // request logging
 
 	r.Use(s.extractPersonFromCookie)
-	r.Use(s.setIsTeacher)
+	r.Use(s.setRoles)
+
+	teacher := requireRole(RoleTeacher)
+	admin := requireRole(RoleSystemAdmin)
+	//Department admins oversee the attendance teachers register, and what the
+	//absentee sync reports of it
+	attendanceReader := requireRole(RoleTeacher, RoleDepartmentAdmin)
+	reportReader := requireRole(RoleDepartmentAdmin, RoleSystemAdmin)
 
-	r.GET("/generate/qr", s.generateQrCode)
-	r.GET("/generate/participationId", s.generateParticipationID)
+	r.GET("/generate/qr", teacher, s.generateQrCode)
+	r.GET("/generate/participationId", teacher, s.generateParticipationID)
+	r.GET("/generate/sheet", teacher, s.getAttendanceSheet)
+	r.POST("/session/close", teacher, s.closeSession)
 
 	r.POST("/absence/registerSickLeave", s.registerSickleave)
 	r.GET("/absence/getSickleaves/:to", s.getSickleaves)
 	r.GET("/absence/count/:from/:to", s.getAbsenceCount)
-	r.GET("/event/retrieve/:from/:to", s.getEventsForTeacher)
+	r.GET("/event/retrieve/:from/:to", teacher, s.getEventsForTeacher)
 	r.GET("/event/participate", s.registerParticipation)
+	r.GET("/attendance/:activityId", attendanceReader, s.getAttendance)
+	r.GET("/attendance/:activityId/stream", teacher, s.streamAttendance)
+	r.GET("/attendance/:activityId/overrides", attendanceReader, s.getOverrides)
+	r.PUT("/attendance/:activityId/overrides/:email", attendanceReader, s.setOverride)
+	r.DELETE("/attendance/:activityId/overrides/:email", attendanceReader, s.deleteOverride)
+	r.GET("/attendance/:activityId/audit", attendanceReader, s.getOverrideAudit)
 	r.GET("/isTeacher", s.getIsTeacher)
+	r.GET("/roles", s.getUserRoles)
+	r.GET("/status/flyvo", admin, s.getFlyvoStatus)
+	r.GET("/absentees/preview", reportReader, s.previewAbsentees)
+	r.GET("/absentees/runs", reportReader, s.getSyncRuns)
+	r.GET("/absentees/runs/:runId", reportReader, s.getSyncRun)
+	r.GET("/jobs", admin, s.getJobs)
+	r.POST("/jobs/:name/run", admin, s.runJob)
 
 	r.GET("/api-doc", swagex.SwaggerEndpoint)
 
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getFlyvoStatus returns the state of the connection to FlyVo
+// @Summary FlyVo connection status
+// @Description Returns whether a FlyVo client is online, how many requests are queued
+// @Description and when each known client was last seen
+// @Produce application/json
+// @Success 200 {string} string "json status object"
+// @Router /status/flyvo [GET]
+func (s *Server) getFlyvoStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, s.RPC.Status())
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+	flyvorpc "github.com/tktip/flyvo-api/internal/flyvo/rpc"
+)
+
+const (
+	//RunRunning - the sync run has not finished
+	RunRunning = "running"
+	//RunSuccess - every activity of the sync run was synced
+	RunSuccess = "success"
+	//RunFailed - the sync run gave up with activities left
+	RunFailed = "failed"
+
+	//runHistoryTTL is how long sync runs are kept.
+	runHistoryTTL = 90 * 24 * time.Hour
+)
+
+//syncRun - a run of the absentee sync, with its attempts
+type syncRun struct {
+	ID         string         `json:"id"`
+	Started    time.Time      `json:"started"`
+	Ended      *time.Time     `json:"ended,omitempty"`
+	Status     string         `json:"status"`
+	Attempts   int            `json:"attempts"`
+	Error      string         `json:"error,omitempty"`
+	Activities []*runActivity `json:"activities"`
+}
+
+//runActivity - what a sync run did with an activity
+type runActivity struct {
+	ActivityID string    `json:"activityId"`
+	CourseID   string    `json:"courseId"`
+	Start      time.Time `json:"start"`
+
+	//State is the state of the activity's sync when the run ended.
+	State string `json:"state"`
+
+	//Absentees is the number of absentees reported, by absence code.
+	Absentees map[string]int `json:"absentees"`
+
+	//Absent are the absent participants as computed by this run, if it started
+	//the activity's sync.
+	Absent []absentee `json:"absent,omitempty"`
+
+	Failures []runFailure `json:"failures,omitempty"`
+}
+
+//runFailure - a failure to register absentees of an activity
+type runFailure struct {
+	At          time.Time `json:"at"`
+	Attempt     int       `json:"attempt"`
+	AbsenceCode string    `json:"absenceCode,omitempty"`
+	Error       string    `json:"error"`
+}
+
+func newSyncRun() *syncRun {
+	return &syncRun{
+		ID:         uuid.New().String(),
+		Started:    time.Now(),
+		Status:     RunRunning,
+		Activities: []*runActivity{},
+	}
+}
+
+//activity returns the activity of the run, adding it if missing.
+func (r *syncRun) activity(a *activitySync) *runActivity {
+	for _, activity := range r.Activities {
+		if activity.ActivityID == a.ActivityID {
+			return activity
+		}
+	}
+
+	activity := &runActivity{
+		ActivityID: a.ActivityID,
+		CourseID:   a.CourseID,
+		Start:      a.Start,
+		Absentees:  map[string]int{},
+	}
+	for _, req := range a.Requests {
+		activity.Absentees[req.AbsenceCode] = len(req.VismaIDs)
+	}
+	r.Activities = append(r.Activities, activity)
+	return activity
+}
+
+//record adds the state of an activity after an attempt to sync it.
+func (r *syncRun) record(a *activitySync) {
+	r.activity(a).State = a.State
+}
+
+//fail adds a failure to sync an activity.
+func (r *syncRun) fail(a *activitySync, code string, err error) {
+	activity := r.activity(a)
+	activity.Failures = append(activity.Failures, runFailure{
+		At:          time.Now(),
+		Attempt:     r.Attempts,
+		AbsenceCode: code,
+		Error:       err.Error(),
+	})
+}
+
+//finish ends the run with the status.
+func (r *syncRun) finish(status string) {
+	now := time.Now()
+	r.Ended = &now
+	r.Status = status
+}
+
+//saveRun persists the run. Failing to is logged only, so the history never
+//stops the sync.
+func (s *Server) saveRun(r *syncRun) {
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = s.repository.SaveSyncRun(r.ID, data, runHistoryTTL)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to save sync run '%s': %s", r.ID, err.Error())
+	}
+}
+
+//syncRuns returns the sync runs, newest first.
+func (s *Server) syncRuns(ctx context.Context) ([]*syncRun, error) {
+	stored, err := s.repo(ctx).SyncRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []*syncRun{}
+	for _, data := range stored {
+		r := &syncRun{}
+		err = json.Unmarshal(data, r)
+		if err != nil {
+			logrus.Warnf("Skipping bad sync run: %s", err.Error())
+			continue
+		}
+		runs = append(runs, r)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.After(runs[j].Started)
+	})
+	return runs, nil
+}
+
+//runFilter - limits the sync runs returned
+type runFilter struct {
+	//from and to limit when the run started.
+	from, to time.Time
+
+	//day limits the activities to those starting that day.
+	day      time.Time
+	activity string
+	email    string
+}
+
+//matches returns whether the run matches the filter, keeping only the
+//activities that match.
+func (f *runFilter) matches(r *syncRun) bool {
+	if !f.from.IsZero() && r.Started.Before(f.from) ||
+		!f.to.IsZero() && !r.Started.Before(f.to) {
+		return false
+	}
+	if f.day.IsZero() && f.activity == "" && f.email == "" {
+		return true
+	}
+
+	activities := []*runActivity{}
+	for _, activity := range r.Activities {
+		if !f.day.IsZero() && (activity.Start.Before(f.day) ||
+			!activity.Start.Before(f.day.AddDate(0, 0, 1))) {
+			continue
+		}
+		if f.activity != "" && activity.ActivityID != calendarid.Encode(f.activity) {
+			continue
+		}
+		if f.email != "" && !activity.hasAbsent(f.email) {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+	r.Activities = activities
+	return len(activities) > 0
+}
+
+func (a *runActivity) hasAbsent(email string) bool {
+	for _, absent := range a.Absent {
+		if strings.EqualFold(absent.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// getSyncRuns returns the history of absentee sync runs
+// @Summary Returns absentee sync runs
+// @Description Returns the runs of the absentee sync, newest first, with what was done
+// @Description with each activity and why it failed
+// @Produce application/json
+// @Param from query string false "runs started this day or later (yyyy-mm-dd)"
+// @Param to query string false "runs started this day or earlier (yyyy-mm-dd)"
+// @Param date query string false "only activities starting this day (yyyy-mm-dd)"
+// @Param activityId query string false "only this activity"
+// @Param email query string false "only activities the participant was reported absent from"
+// @Success 200 {string} string "json list of sync runs"
+// @Failure 400 {string} string "If bad date"
+// @Failure 403 {string} string "If unauthorized (not department or system admin)"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /absentees/runs [GET]
+func (s *Server) getSyncRuns(c *gin.Context) {
+	filter := runFilter{
+		activity: c.Query("activityId"),
+		email:    c.Query("email"),
+	}
+
+	loc, err := flyvorpc.LoadTimeZone(s.RPC.TimeZone)
+	if err != nil {
+		logrus.Errorf("Failed to load time zone: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to load time zone",
+			CodeInternalErrorGeneral,
+		))
+		return
+	}
+
+	bounds := map[string]*time.Time{
+		"from": &filter.from,
+		"to":   &filter.to,
+		"date": &filter.day,
+	}
+	for param, bound := range bounds {
+		if c.Query(param) == "" {
+			continue
+		}
+		*bound, err = time.ParseInLocation(layoutISO, c.Query(param), loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, codedErrorResponse(
+				fmt.Sprintf("bad %s date value", param),
+				CodeBadRequest,
+			))
+			return
+		}
+	}
+	if !filter.to.IsZero() {
+		filter.to = filter.to.AddDate(0, 0, 1)
+	}
+
+	runs, err := s.syncRuns(c.Request.Context())
+	if err != nil {
+		logrus.Errorf("Failed to get sync runs: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get sync runs from db",
+			CodeRedisError,
+		))
+		return
+	}
+
+	matching := []*syncRun{}
+	for _, r := range runs {
+		if filter.matches(r) {
+			matching = append(matching, r)
+		}
+	}
+	c.JSON(http.StatusOK, matching)
+}
+
+// getSyncRun returns an absentee sync run
+// @Summary Returns an absentee sync run
+// @Description Returns a run of the absentee sync, with what was done with each activity
+// @Produce application/json
+// @Param runId path string true "id of the run"
+// @Success 200 {string} string "json sync run"
+// @Failure 403 {string} string "If unauthorized (not department or system admin)"
+// @Failure 404 {string} string "If there is no such run"
+// @Failure 500 {string} string "On any other error (e.g. redis)"
+// @Router /absentees/runs/{runId} [GET]
+func (s *Server) getSyncRun(c *gin.Context) {
+	stored, err := s.repo(c.Request.Context()).SyncRun(c.Param("runId"))
+	if err != nil {
+		logrus.Errorf("Failed to get sync run: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, codedErrorResponse(
+			"failed to get sync run from db",
+			CodeRedisError,
+		))
+		return
+	} else if stored == nil {
+		c.JSON(http.StatusNotFound, codedErrorResponse("no such run", CodeNotFound))
+		return
+	}
+
+	c.Header("content-type", "application/json")
+	c.String(http.StatusOK, string(stored))
+}
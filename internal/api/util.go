@@ -1,15 +1,10 @@
 package api
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
-	"math/rand"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/tktip/flyvo-api/internal/identity"
 	jwtsessions "github.com/tktip/google-auth-proxy/pkg/jwt-sessions"
 
 	"github.com/gin-gonic/gin"
@@ -19,64 +14,17 @@ import (
 //revive:disable:unused-receiver
 
 var (
-	letterRunes    = []rune("1234567890")
 	teacherTimeout = time.Minute * 60
 )
 
-func randStringRunes(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-	return string(b)
-}
-
-//revive:disable-next-line:cyclomatic
-func (s *Server) mailBelongsToTeacher(email string) (isTeacher bool, err error) {
-	if email == "" {
-		return false, errors.New("no email")
-	}
-
-	var cachedVal string
-	cachedVal, err = s.Redis.GetStringValue("teacher-" + email)
-	if err == redis.Nil || cachedVal == "false" {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	} else if cachedVal == "true" {
-		return true, nil
-	}
-
-	isTeacher, err = s.Trovo.IsMemberOfTeacherGroup(email)
-	if err != nil {
-		return
-	}
-
-	val := "true"
-	if !isTeacher {
-		val = "false"
-	}
-
-	//Disregarding this error as it won't cause any issues.
-	err = s.Redis.WriteValue("teacher-"+email, val, teacherTimeout)
-	if err != nil {
-		logrus.Errorf("Failed to write value to redis: %s", err.Error())
-	}
-
-	return isTeacher, nil
-
-}
-
 func (s *Server) extractPersonFromCookie(c *gin.Context) {
-	if true {
-		c.Set("person", &jwtsessions.GToken{
-			FamilyName: "Bentdal",
-			GivenName:  "Simen",
-			Email:      "simen.bentdal@trondheim.kommune.no",
-		})
+	if s.Auth.DevImpersonation.Enabled {
+		c.Set("person", s.Auth.impersonated())
+		c.Next()
 		return
 	}
-	header := c.GetHeader("userInfo")
+
+	header := c.GetHeader(s.Auth.Header)
 
 	if header == "" {
 		logrus.Info("Missing userinfo. Request did most likely not from auth-proxy")
@@ -87,12 +35,12 @@ func (s *Server) extractPersonFromCookie(c *gin.Context) {
 		return
 	}
 
-	person := &jwtsessions.GToken{}
-	err := json.Unmarshal([]byte(header), person)
+	person, err := s.Auth.verify(header)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error":     err.Error(),
-			"errorCode": CodeInternalErrorGeneral,
+		logrus.Warnf("Rejected userinfo token: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error":     "invalid oauth header",
+			"errorCode": CodeNotAuthenticated,
 		})
 		return
 	}
@@ -100,50 +48,27 @@ func (s *Server) extractPersonFromCookie(c *gin.Context) {
 	c.Next()
 }
 
-func (s *Server) setIsTeacher(c *gin.Context) {
-	if true {
-		c.Set("teacher", true)
-		return
-	}
-	person, ok := c.Get("person")
-	if !ok {
-		logrus.Error("Reached setIsTeacher without person set.")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error":     "invalid internal state",
-			"errorCode": CodeInternalErrorGeneral,
-		})
-		return
-	}
-
-	p, ok := person.(*jwtsessions.GToken)
-	if !ok {
-		fmt.Print()
-	}
-
-	isTeacher, err := s.mailBelongsToTeacher(p.Email)
-	if err != nil {
-
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error":     err.Error(),
-			"errorCode": CodeInternalErrorGeneral,
-		})
-		return
-	}
-
-	c.Set("teacher", isTeacher)
-	c.Next()
-}
-
-func extractVismaID(email string) string {
-	split := strings.Split(email, "@")
-	//Example, for pål testesen: pt12345@...
-	//vismaID = 12345.
-
-	if len(split) == 0 || len(split[0]) < 3 {
-		logrus.Warnf("Mail was bad: %s", email)
-		return ""
+//vismaID returns the visma ID of the user with email, aborting the request if
+//it cannot be found.
+func (s *Server) vismaID(c *gin.Context, email string) (string, bool) {
+	id, err := s.Identity.VismaID(email)
+	if err == identity.ErrUnknown {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity,
+			codedErrorResponse(
+				"no visma ID for user",
+				CodeNotFound,
+			))
+		return "", false
+	} else if err != nil {
+		logrus.Errorf("Failed to look up visma ID of '%s': %s", email, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError,
+			codedErrorResponse(
+				"failed to look up visma ID",
+				CodeInternalErrorGeneral,
+			))
+		return "", false
 	}
-	return split[0][2:]
+	return id, true
 }
 
 func isTeacherWithoutError(c *gin.Context) bool {
@@ -157,29 +82,6 @@ func isTeacherWithoutError(c *gin.Context) bool {
 	return true
 }
 
-func isTeacher(c *gin.Context) bool {
-	t, ok := c.Get("teacher")
-	if !ok {
-		c.AbortWithStatusJSON(http.StatusInternalServerError,
-			codedErrorResponse(
-				"invalid internal state",
-				CodeInternalErrorGeneral,
-			))
-		return false
-	}
-
-	if !t.(bool) {
-		c.AbortWithStatusJSON(http.StatusInternalServerError,
-			codedErrorResponse(
-				"must have teacher privileges",
-				CodeForbidden,
-			))
-		return false
-	}
-
-	return true
-}
-
 func getPersonObject(c *gin.Context) (*jwtsessions.GToken, bool) {
 	t, ok := c.Get("person")
 	if !ok || t == nil {
@@ -0,0 +1,288 @@
+package attendance
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/storage"
+)
+
+const (
+	defaultRotation      = 30 * time.Second
+	defaultGrace         = 1
+	defaultDuration      = 4 * time.Hour
+	defaultCodeLength    = 8
+	defaultMaxAttempts   = 5
+	defaultAttemptWindow = 15 * time.Minute
+
+	secretLength = 32
+
+	//codeAlphabet leaves out characters easily mistaken for each other (0/O, 1/I).
+	//Its length divides 256, so every character is equally likely.
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	sessionPrefix  = "attendance-session-"
+	codePrefix     = "attendance-code-"
+	attemptsPrefix = "attendance-attempts-"
+)
+
+var (
+	//ErrUnknownCode - the code does not belong to an open session, or has rotated out
+	ErrUnknownCode = errors.New("unknown or expired participation code")
+
+	//ErrSessionClosed - the session the code belongs to has been closed
+	ErrSessionClosed = errors.New("attendance session is closed")
+
+	//ErrNoSession - there is no open session for the activity
+	ErrNoSession = errors.New("no open attendance session for activity")
+
+	//ErrTooManyAttempts - the user has entered too many codes recently
+	ErrTooManyAttempts = errors.New("too many attempts, try again later")
+)
+
+//Sessions - attendance sessions opened by teachers, during which participants
+//register with short lived codes that rotate
+type Sessions struct {
+	//Rotation is how often a new code is shown. Defaults to 30s.
+	Rotation time.Duration `yaml:"rotation"`
+	//Grace is how many codes before the current one are still accepted. Defaults to 1.
+	Grace int `yaml:"grace"`
+	//Duration is how long a session stays open unless closed. Defaults to 4h.
+	Duration time.Duration `yaml:"duration"`
+	//CodeLength is the number of characters in a code. Defaults to 8.
+	CodeLength int `yaml:"codeLength"`
+	//MaxAttempts is how many codes a user may enter within AttemptWindow.
+	MaxAttempts int64 `yaml:"maxAttempts"`
+	//AttemptWindow is how long attempts are counted. Defaults to 15m.
+	AttemptWindow time.Duration `yaml:"attemptWindow"`
+
+	store storage.Store
+}
+
+//session is the state of an attendance session, kept in storage. The codes are
+//derived from the secret, so only the current code needs a lookup key.
+type session struct {
+	ActivityID string    `json:"activityId"`
+	Secret     []byte    `json:"secret"`
+	OpenedBy   string    `json:"openedBy"`
+	Opened     time.Time `json:"opened"`
+	Expires    time.Time `json:"expires"`
+	Closed     bool      `json:"closed"`
+}
+
+//Code - the code currently shown for a session
+type Code struct {
+	Code           string    `json:"participationId"`
+	RotatesAt      time.Time `json:"rotatesAt"`
+	SessionExpires time.Time `json:"sessionExpires"`
+}
+
+//Init - sets defaults and the store sessions are kept in
+func (s *Sessions) Init(store storage.Store) {
+	s.store = store
+	if s.Rotation <= 0 {
+		s.Rotation = defaultRotation
+	}
+	if s.Grace < 0 {
+		s.Grace = 0
+	} else if s.Grace == 0 {
+		s.Grace = defaultGrace
+	}
+	if s.Duration <= 0 {
+		s.Duration = defaultDuration
+	}
+	if s.CodeLength <= 0 {
+		s.CodeLength = defaultCodeLength
+	} else if s.CodeLength > sha256.Size {
+		s.CodeLength = sha256.Size
+	}
+	if s.MaxAttempts <= 0 {
+		s.MaxAttempts = defaultMaxAttempts
+	}
+	if s.AttemptWindow <= 0 {
+		s.AttemptWindow = defaultAttemptWindow
+	}
+}
+
+//Open - returns the current code of the activity's session, opening a new
+//session if there is none open
+func (s *Sessions) Open(activityID string, teacher string) (Code, error) {
+	sess, err := s.load(activityID)
+	if err != nil {
+		return Code{}, err
+	}
+
+	now := time.Now()
+	if sess == nil || sess.Closed || now.After(sess.Expires) {
+		secret := make([]byte, secretLength)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return Code{}, err
+		}
+
+		sess = &session{
+			ActivityID: activityID,
+			Secret:     secret,
+			OpenedBy:   teacher,
+			Opened:     now,
+			Expires:    now.Add(s.Duration),
+		}
+		err = s.save(sess)
+		if err != nil {
+			return Code{}, err
+		}
+		logrus.Infof("Attendance session for '%s' opened by '%s'", activityID, teacher)
+	}
+
+	return s.current(sess, now)
+}
+
+//Close - closes the activity's session, so its codes are no longer accepted
+func (s *Sessions) Close(activityID string, teacher string) error {
+	sess, err := s.load(activityID)
+	if err != nil {
+		return err
+	} else if sess == nil || sess.Closed || time.Now().After(sess.Expires) {
+		return ErrNoSession
+	}
+
+	sess.Closed = true
+	err = s.save(sess)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Attendance session for '%s' closed by '%s'", activityID, teacher)
+	return nil
+}
+
+//Validate - returns the activity the code belongs to
+func (s *Sessions) Validate(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != s.CodeLength || strings.Trim(code, codeAlphabet) != "" {
+		return "", ErrUnknownCode
+	}
+
+	activityID, err := s.store.PeekValue(codePrefix + code)
+	if err != nil {
+		return "", err
+	} else if activityID == nil {
+		return "", ErrUnknownCode
+	}
+
+	sess, err := s.load(string(activityID))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if sess == nil || sess.Closed || now.After(sess.Expires) {
+		return "", ErrSessionClosed
+	}
+
+	counter := s.counter(now)
+	for i := int64(0); i <= int64(s.Grace); i++ {
+		if hmac.Equal([]byte(code), []byte(s.code(sess, counter-i))) {
+			return sess.ActivityID, nil
+		}
+	}
+	return "", ErrUnknownCode
+}
+
+//Verify - returns the activity the code belongs to. Every code entered counts
+//against the user before it is checked, so parallel guesses can not get past
+//the limit. Users with too many recent attempts are rejected outright.
+func (s *Sessions) Verify(code string, email string) (string, error) {
+	n, err := s.store.Increment(attemptsPrefix+email, s.AttemptWindow)
+	if err != nil {
+		return "", err
+	}
+	if n > s.MaxAttempts {
+		if n == s.MaxAttempts+1 {
+			logrus.Warnf("'%s' entered %d participation codes, blocking for %s",
+				email,
+				s.MaxAttempts,
+				s.AttemptWindow,
+			)
+		}
+		return "", ErrTooManyAttempts
+	}
+
+	return s.Validate(code)
+}
+
+//current returns the code of the session at now, and makes it possible to look
+//up until it has rotated out of the grace period.
+func (s *Sessions) current(sess *session, now time.Time) (Code, error) {
+	counter := s.counter(now)
+	code := s.code(sess, counter)
+
+	rotatesAt := time.Unix(0, (counter+1)*int64(s.Rotation))
+	validUntil := rotatesAt.Add(time.Duration(s.Grace) * s.Rotation)
+	err := s.store.WriteValue(codePrefix+code, sess.ActivityID, validUntil.Sub(now))
+	if err != nil {
+		return Code{}, err
+	}
+
+	return Code{
+		Code:           code,
+		RotatesAt:      rotatesAt,
+		SessionExpires: sess.Expires,
+	}, nil
+}
+
+//counter is the number of rotations since the epoch.
+func (s *Sessions) counter(t time.Time) int64 {
+	return t.UnixNano() / int64(s.Rotation)
+}
+
+//code derives the code of the session for a rotation.
+func (s *Sessions) code(sess *session, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha256.New, sess.Secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	code := make([]byte, s.CodeLength)
+	for i := range code {
+		code[i] = codeAlphabet[int(sum[i])%len(codeAlphabet)]
+	}
+	return string(code)
+}
+
+func (s *Sessions) load(activityID string) (*session, error) {
+	data, err := s.store.PeekValue(sessionPrefix + activityID)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	sess := &session{}
+	err = json.Unmarshal(data, sess)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+//save stores the session until it expires.
+func (s *Sessions) save(sess *session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(sess.Expires)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return s.store.WriteValue(sessionPrefix+sess.ActivityID, string(data), ttl)
+}
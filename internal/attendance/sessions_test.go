@@ -0,0 +1,59 @@
+package attendance
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/tktip/flyvo-api/internal/storage"
+)
+
+func testSessions(t *testing.T) *Sessions {
+	cfg := storage.Config{Backend: storage.BackendFile}
+	cfg.File.Path = filepath.Join(t.TempDir(), "state.json")
+	store, err := cfg.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Sessions{MaxAttempts: 3}
+	s.Init(store)
+	return s
+}
+
+func TestVerifyParallelGuesses(t *testing.T) {
+	s := testSessions(t)
+	code, err := s.Open("activity", "teacher@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	checked := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Verify("WRONGCODE", "guesser@example.com")
+			if err != ErrTooManyAttempts {
+				lock.Lock()
+				checked++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if checked != int(s.MaxAttempts) {
+		t.Errorf("%d guesses were checked, want %d", checked, s.MaxAttempts)
+	}
+
+	_, err = s.Verify(code.Code, "guesser@example.com")
+	if err != ErrTooManyAttempts {
+		t.Errorf("got error %v for the right code once blocked, want %v", err, ErrTooManyAttempts)
+	}
+	activityID, err := s.Verify(code.Code, "participant@example.com")
+	if err != nil || activityID != "activity" {
+		t.Errorf("got %q, %v for another user, want %q", activityID, err, "activity")
+	}
+}
@@ -0,0 +1,66 @@
+package calendarid
+
+import (
+	"encoding/base32"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+//encoding is lower case base32hex, whose alphabet (0-9 and a-v) is what google
+//calendar allows in event ids. Event ids must be 5 to 1024 characters long,
+//so activity ids must be at most 640 bytes, and shorter ones than 3 are padded.
+var encoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").
+	WithPadding(base32.NoPadding)
+
+const (
+	//minLength is the number of bytes encoding to the shortest event id.
+	minLength = 3
+	//padding lengthens shorter activity ids. It never occurs in utf-8, so padded
+	//ids can not be mistaken for other activity ids.
+	padding = 0xff
+)
+
+var (
+	//ErrNotEncoded - the event id was not encoded from an activity id
+	ErrNotEncoded = errors.New("not an encoded activity id")
+
+	legacyChars = regexp.MustCompile(`([a-z0-9])*`)
+)
+
+//Encode - returns the calendar event id of the visma activity. Different
+//activities always get different event ids, and Decode returns the activity id.
+//Activity ids shorter than 3 bytes are padded, so event ids are long enough.
+func Encode(activityID string) string {
+	data := []byte(activityID)
+	for len(data) < minLength {
+		data = append(data, padding)
+	}
+	return encoding.EncodeToString(data)
+}
+
+//Decode - returns the visma activity id of the calendar event id, or
+//ErrNotEncoded if the event id was not returned by Encode. Most legacy event
+//ids are not valid encodings, but some are, so match against known activities
+//where legacy ids may occur.
+func Decode(eventID string) (string, error) {
+	data, err := encoding.DecodeString(eventID)
+	if err != nil {
+		return "", ErrNotEncoded
+	}
+	for len(data) > 0 && data[len(data)-1] == padding {
+		data = data[:len(data)-1]
+	}
+	if !utf8.Valid(data) || Encode(string(data)) != eventID {
+		return "", ErrNotEncoded
+	}
+	return string(data), nil
+}
+
+//Legacy - returns the event id earlier versions gave the activity: its id in
+//lower case with everything but letters and digits dropped. Several activities
+//may have the same legacy id, and it can not be decoded.
+func Legacy(activityID string) string {
+	return strings.Join(legacyChars.FindAllString(strings.ToLower(activityID), -1), "")
+}
@@ -0,0 +1,83 @@
+package calendarid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		activityID string
+		want       string
+	}{
+		{"abc", "c5h66"},
+		{"123456", "64p36d1l6o"},
+		{"AB-12", "8512qc9i"},
+		{"ab", "c5hfu"},
+		{"a", "c7vvu"},
+		{"", "vvvvu"},
+		{"æøå", "oejc7e63kk"},
+		{strings.Repeat("x", 640), strings.Repeat("f1s7gu3o", 128)},
+	}
+	for _, test := range tests {
+		got := Encode(test.activityID)
+		if got != test.want {
+			t.Errorf("Encode(%q) = %q, want %q", test.activityID, got, test.want)
+		}
+		if len(got) < 5 || len(got) > 1024 {
+			t.Errorf("Encode(%q) = %q, not 5 to 1024 characters", test.activityID, got)
+		}
+		if strings.Trim(got, "0123456789abcdefghijklmnopqrstuv") != "" {
+			t.Errorf("Encode(%q) = %q, not base32hex", test.activityID, got)
+		}
+
+		activityID, err := Decode(got)
+		if err != nil || activityID != test.activityID {
+			t.Errorf("Decode(%q) = %q, %v, want %q", got, activityID, err, test.activityID)
+		}
+	}
+}
+
+func TestDecodeNotEncoded(t *testing.T) {
+	tests := []struct {
+		name    string
+		eventID string
+	}{
+		{"empty", ""},
+		{"upper case", "C5H66"},
+		{"padded", "c5h66==="},
+		{"outside alphabet", "c5h6w"},
+		{"impossible length", "c5h6"},
+		{"trailing bits set", "c5h67"},
+		{"invalid utf-8", encoding.EncodeToString([]byte{0xfe, 0xfe, 0xfe})},
+		{"padding in the middle", encoding.EncodeToString([]byte{'a', padding, 'b'})},
+		{"padding of long id", encoding.EncodeToString([]byte{'a', 'b', 'c', padding})},
+		{"legacy id", "ab12"},
+	}
+	for _, test := range tests {
+		activityID, err := Decode(test.eventID)
+		if err != ErrNotEncoded {
+			t.Errorf("%s: Decode(%q) = %q, %v, want %v",
+				test.name, test.eventID, activityID, err, ErrNotEncoded)
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	tests := []struct {
+		activityIDs []string
+		want        string
+	}{
+		{[]string{"ab12", "AB12", "AB-12", "a b_1.2", "ab/12"}, "ab12"},
+		{[]string{"æøå", "-", ""}, ""},
+		{[]string{"C5H-66", "c5h66"}, "c5h66"},
+	}
+	for _, test := range tests {
+		for _, activityID := range test.activityIDs {
+			got := Legacy(activityID)
+			if got != test.want {
+				t.Errorf("Legacy(%q) = %q, want %q", activityID, got, test.want)
+			}
+		}
+	}
+}
@@ -6,17 +6,49 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tktip/flyvo-api/internal/flyvo/rpc"
 )
 
-//revive:disable:unnecessary-stmt
+//rpcErrorCode - the errorCode of rpc errors, kept apart from the codes of the api
+type rpcErrorCode int
+
+const (
+	//CodeRPCError - the request to the flyvo client failed
+	CodeRPCError rpcErrorCode = 3000
+
+	//CodeClientOffline - no flyvo client is connected
+	CodeClientOffline rpcErrorCode = 3001
+
+	//CodeQueued - the request is queued for delivery to the flyvo client
+	CodeQueued rpcErrorCode = 3002
+)
+
+const (
+	//offlineRetryAfter is the number of seconds clients are told to wait before
+	//retrying when FlyVo is offline.
+	offlineRetryAfter = "60"
+)
 
 //HandleRPCError responds with a proper response based on error from rpc.
 func HandleRPCError(c *gin.Context, err error) {
-	switch err.Error() {
+	switch err {
+	case rpc.ErrQueued:
+		c.JSON(http.StatusAccepted, gin.H{
+			"error":     err.Error(),
+			"errorCode": CodeQueued,
+		})
+		logrus.Info("Rpc request queued")
+	case rpc.ErrClientOffline:
+		c.Header("Retry-After", offlineRetryAfter)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":     err.Error(),
+			"errorCode": CodeClientOffline,
+		})
+		logrus.Warnf("Rpc error: %s", err.Error())
 	default:
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":     err.Error(),
-			"errorCode": 3000,
+			"errorCode": CodeRPCError,
 		})
 		logrus.Errorf("Rpc error: %s", err.Error())
 	}
@@ -25,11 +25,45 @@ type genericReaderWriter struct {
 }
 
 //asyncAsSync is a set of open requests from frontend. I.e. frontend functions
-//add their requests to this set, and then await responses put in those requests'
-//separate writers.
+//add their requests to the queue, and then await responses put in those requests'
+//separate writers. Writers are kept by request ID, and are gone once the caller
+//stops waiting.
 type asyncAsSync struct {
 	lock    sync.Mutex
-	readers []*genericReaderWriter
+	readers map[string]*genericReaderWriter
+	queue   requestQueue
+	notify  chan struct{}
+}
+
+//queued wakes up a connected client stream waiting for new requests.
+func (a *asyncAsSync) queued() {
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (a *asyncAsSync) addReader(g *genericReaderWriter) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.readers == nil {
+		a.readers = map[string]*genericReaderWriter{}
+	}
+	a.readers[g.id] = g
+}
+
+func (a *asyncAsSync) removeReader(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.readers, id)
+}
+
+//reader returns the writer awaiting response for request with id, or nil if
+//no caller is waiting for it anymore.
+func (a *asyncAsSync) reader(id string) *genericReaderWriter {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.readers[id]
 }
 
 //This function writes data to the error channel and then closes the writer,
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+	"github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+const (
+	//locationMargin is how long after an event has ended its location is kept.
+	locationMargin = 24 * time.Hour
+	//defaultLocationTTL is used for events without a readable end time.
+	defaultLocationTTL = 30 * 24 * time.Hour
+)
+
+//EventLocation - where an event takes place, as sent by FlyVo
+type EventLocation struct {
+	Location string `json:"location"`
+	Room     string `json:"room"`
+}
+
+//locationKey is keyed by the calendar event id of the activity.
+func locationKey(activityID string) string {
+	return "event-location-" + calendarid.Encode(activityID)
+}
+
+//saveLocation remembers where the event takes place until after it has ended.
+func (srv *Server) saveLocation(in *rpc.Event) {
+	data, err := json.Marshal(EventLocation{
+		Location: in.Location,
+		Room:     in.Room,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to marshal location of '%s': %s", in.VismaActivityId, err.Error())
+		return
+	}
+
+	ttl := defaultLocationTTL
+	if end, err := time.Parse(time.RFC3339, in.To); err == nil {
+		ttl = time.Until(end) + locationMargin
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	err = srv.Store.WriteValue(locationKey(in.VismaActivityId), string(data), ttl)
+	if err != nil {
+		logrus.Errorf("Failed to store location of '%s': %s", in.VismaActivityId, err.Error())
+	}
+}
+
+//EventLocation - returns where the activity takes place, or nil if unknown
+func (srv *Server) EventLocation(activityID string) (*EventLocation, error) {
+	data, err := srv.Store.PeekValue(locationKey(activityID))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	location := &EventLocation{}
+	err = json.Unmarshal(data, location)
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
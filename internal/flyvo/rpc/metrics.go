@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"strconv"
+
+	"github.com/tktip/flyvo-api/pkg/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram(
+		"flyvo_rpc_request_duration_seconds",
+		"Time from a request is published until the flyvo client responds, per path.",
+		metrics.DefaultBuckets,
+		"path",
+	)
+
+	requestFailures = metrics.NewCounter(
+		"flyvo_rpc_request_failures_total",
+		"Requests to the flyvo client that failed, per path and reason.",
+		"path", "reason",
+	)
+
+	streamErrors = metrics.NewCounter(
+		"flyvo_rpc_stream_errors_total",
+		"Client request streams ending in error, io.EOF counted as 'eof'.",
+		"reason",
+	)
+
+	queueDepth = metrics.NewGaugeFunc(
+		"flyvo_rpc_queue_depth",
+		"Requests queued for the flyvo client.",
+		func() float64 { return 0 },
+	)
+
+	gcalResponses = metrics.NewCounter(
+		"flyvo_gcal_responses_total",
+		"Responses from the calendar service, per endpoint and HTTP status.",
+		"endpoint", "status",
+	)
+)
+
+//CountGcalResponse - counts a response from the calendar service to a request
+//to @endpoint. The api counts its own requests to the calendar here as well.
+func CountGcalResponse(endpoint string, status int) {
+	gcalResponses.Inc(endpoint, strconv.Itoa(status))
+}
@@ -0,0 +1,186 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultOfflineAfter = 2 * time.Minute
+
+	//clientIDHeader is the grpc metadata key a client may identify itself with.
+	//Clients without it are identified by their address.
+	clientIDHeader = "client-id"
+)
+
+//ClientStatus - the last known state of a flyvo client
+type ClientStatus struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Connected bool      `json:"connected"`
+}
+
+//Status - the state of the rpc server as seen from the api
+type Status struct {
+	Online  bool           `json:"online"`
+	Queued  int            `json:"queued"`
+	Clients []ClientStatus `json:"clients"`
+}
+
+//presence keeps track of when flyvo clients were last seen, and which have a
+//request stream open.
+type presence struct {
+	lock    sync.Mutex
+	started time.Time
+	clients map[string]*ClientStatus
+	streams map[string]int
+}
+
+func newPresence() *presence {
+	return &presence{
+		started: time.Now(),
+		clients: map[string]*ClientStatus{},
+		streams: map[string]int{},
+	}
+}
+
+//seen registers contact with the client calling with ctx, and returns its ID.
+func (p *presence) seen(ctx context.Context) string {
+	address := ""
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		address = pr.Addr.String()
+	}
+
+	id := address
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(clientIDHeader); len(vals) > 0 && vals[0] != "" {
+			id = vals[0]
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	client, ok := p.clients[id]
+	if !ok {
+		client = &ClientStatus{ID: id}
+		p.clients[id] = client
+	}
+	client.Address = address
+	client.LastSeen = time.Now()
+	return id
+}
+
+//touch updates last seen for a known client.
+func (p *presence) touch(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if client, ok := p.clients[id]; ok {
+		client.LastSeen = time.Now()
+	}
+}
+
+//streamOpened marks a client as having a request stream open.
+func (p *presence) streamOpened(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.streams[id]++
+}
+
+//streamClosed marks a request stream of a client as closed.
+func (p *presence) streamClosed(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.streams[id]--
+	if p.streams[id] <= 0 {
+		delete(p.streams, id)
+	}
+	if client, ok := p.clients[id]; ok {
+		client.LastSeen = time.Now()
+	}
+}
+
+//online reports whether any client has a stream open or has been seen within
+//the given duration. Until then, the server counts as having seen a client at
+//startup, giving clients time to connect.
+func (p *presence) online(within time.Duration) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.streams) > 0 {
+		return true
+	}
+
+	latest := p.started
+	for _, client := range p.clients {
+		if client.LastSeen.After(latest) {
+			latest = client.LastSeen
+		}
+	}
+	return time.Since(latest) < within
+}
+
+//list returns the known clients, most recently seen first.
+func (p *presence) list() []ClientStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	clients := make([]ClientStatus, 0, len(p.clients))
+	for id, client := range p.clients {
+		c := *client
+		c.Connected = p.streams[id] > 0
+		clients = append(clients, c)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].LastSeen.After(clients[j].LastSeen)
+	})
+	return clients
+}
+
+func (srv *Server) offlineAfter() time.Duration {
+	if srv.OfflineAfter <= 0 {
+		return defaultOfflineAfter
+	}
+	return srv.OfflineAfter
+}
+
+//Online - whether a flyvo client has been in contact recently. No client can
+//have been before the grpc server listens, which it does after Init.
+func (srv *Server) Online() bool {
+	if atomic.LoadInt32(&srv.listening) == 0 || srv.presence == nil {
+		return false
+	}
+	return srv.presence.online(srv.offlineAfter())
+}
+
+//CheckClient - returns an error if no flyvo client has been in contact recently
+func (srv *Server) CheckClient() error {
+	if !srv.Online() {
+		return fmt.Errorf("no flyvo client seen for %s", srv.offlineAfter())
+	}
+	return nil
+}
+
+//Status - returns the state of the rpc server and known flyvo clients
+func (srv *Server) Status() Status {
+	queued, err := srv.asyncs.queue.Len()
+	if err != nil {
+		logrus.Warnf("Failed to get queue length: %s", err.Error())
+	}
+
+	return Status{
+		Online:  srv.Online(),
+		Queued:  queued,
+		Clients: srv.presence.list(),
+	}
+}
@@ -0,0 +1,228 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/redis"
+	"github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+const (
+	//QueueMemory - pending requests are kept in memory and lost on restart
+	QueueMemory = "memory"
+
+	//QueueRedis - pending requests are kept in redis and survive restarts
+	QueueRedis = "redis"
+
+	//The keys share the hash tag {rpcqueue}, so they are in the same slot of a
+	//redis cluster, and requests can be moved between the lists atomically.
+	queuePendingKey    = "{rpcqueue}-pending"
+	queueProcessingKey = "{rpcqueue}-processing"
+	queueItemsKey      = "{rpcqueue}-items"
+)
+
+var (
+	//durablePaths are fire-and-forget writes that must reach the flyvo client
+	//even if the caller has stopped waiting for them.
+	durablePaths = map[string]bool{
+		rpc.PathRegisterAbsences:  true,
+		rpc.PathRegisterSickLeave: true,
+	}
+)
+
+//isDurable returns whether @g must reach the flyvo client even if the caller
+//stops waiting. Only requests kept in a queue that survives restarts are.
+func (srv *Server) isDurable(g *rpc.Generic) bool {
+	return durablePaths[g.Path] && srv.asyncs.queue.Durable()
+}
+
+//requestQueue holds requests from frontend until they have been processed by
+//the flyvo client. Requests are identified by their MsgID.
+type requestQueue interface {
+	//Push adds a request to the end of the queue.
+	Push(g *rpc.Generic) error
+
+	//Take moves all pending requests to processing and returns them in order.
+	Take() ([]*rpc.Generic, error)
+
+	//Ack removes a request in processing from the queue.
+	Ack(g *rpc.Generic) error
+
+	//Requeue moves a request in processing back to the front of pending, so
+	//it is taken before requests pushed since.
+	Requeue(g *rpc.Generic) error
+
+	//Len returns the number of pending requests.
+	Len() (int, error)
+
+	//Durable returns whether the queue survives restarts.
+	Durable() bool
+}
+
+func newRequestQueue(kind string, conn *redis.Connector) (requestQueue, error) {
+	switch kind {
+	case "", QueueMemory:
+		return &memoryQueue{processing: map[string]*rpc.Generic{}}, nil
+	case QueueRedis:
+		if conn == nil {
+			return nil, errors.New("redis queue requires redis config")
+		}
+		q := &redisQueue{conn: conn}
+		return q, q.recover()
+	default:
+		return nil, fmt.Errorf("unknown queue type '%s'", kind)
+	}
+}
+
+//memoryQueue is a requestQueue that does not survive restarts.
+type memoryQueue struct {
+	lock       sync.Mutex
+	pending    []*rpc.Generic
+	processing map[string]*rpc.Generic
+}
+
+func (q *memoryQueue) Push(g *rpc.Generic) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pending = append(q.pending, g)
+	return nil
+}
+
+func (q *memoryQueue) Take() ([]*rpc.Generic, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	taken := q.pending
+	q.pending = nil
+	for _, g := range taken {
+		q.processing[g.MsgID] = g
+	}
+	return taken, nil
+}
+
+func (q *memoryQueue) Ack(g *rpc.Generic) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.processing, g.MsgID)
+	return nil
+}
+
+func (q *memoryQueue) Requeue(g *rpc.Generic) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.processing, g.MsgID)
+	q.pending = append([]*rpc.Generic{g}, q.pending...)
+	return nil
+}
+
+func (q *memoryQueue) Len() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending), nil
+}
+
+func (q *memoryQueue) Durable() bool {
+	return false
+}
+
+//redisQueue is a requestQueue persisted in redis. Request bodies are stored in
+//a hash keyed on MsgID, while the pending and processing lists hold the IDs.
+type redisQueue struct {
+	conn *redis.Connector
+}
+
+//recover moves requests that were being processed when the server stopped
+//back to pending.
+func (q *redisQueue) recover() error {
+	count := 0
+	for {
+		id, err := q.conn.MoveListTail(queueProcessingKey, queuePendingKey)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			break
+		}
+		count++
+	}
+
+	if count > 0 {
+		logrus.Infof("Recovered %d unprocessed requests from redis queue", count)
+	}
+	return nil
+}
+
+func (q *redisQueue) Push(g *rpc.Generic) error {
+	data, err := proto.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	err = q.conn.SetHashValue(queueItemsKey, g.MsgID, data)
+	if err != nil {
+		return err
+	}
+
+	return q.conn.PushToList(queuePendingKey, g.MsgID)
+}
+
+func (q *redisQueue) Take() ([]*rpc.Generic, error) {
+	var taken []*rpc.Generic
+	for {
+		id, err := q.conn.MoveListTail(queuePendingKey, queueProcessingKey)
+		if err != nil {
+			return taken, err
+		}
+		if id == "" {
+			return taken, nil
+		}
+
+		data, err := q.conn.GetHashValue(queueItemsKey, id)
+		if err != nil {
+			return taken, err
+		}
+		if data == nil {
+			logrus.Warnf("%s: Queued request has no content, dropping it", id)
+			if err = q.conn.RemoveFromList(queueProcessingKey, id); err != nil {
+				return taken, err
+			}
+			continue
+		}
+
+		g := &rpc.Generic{}
+		if err = proto.Unmarshal(data, g); err != nil {
+			return taken, err
+		}
+		taken = append(taken, g)
+	}
+}
+
+func (q *redisQueue) Ack(g *rpc.Generic) error {
+	err := q.conn.RemoveFromList(queueProcessingKey, g.MsgID)
+	if err != nil {
+		return err
+	}
+	return q.conn.DeleteHashValue(queueItemsKey, g.MsgID)
+}
+
+func (q *redisQueue) Requeue(g *rpc.Generic) error {
+	err := q.conn.RemoveFromList(queueProcessingKey, g.MsgID)
+	if err != nil {
+		return err
+	}
+
+	//Requests are taken from the tail, so it goes back there to be next.
+	return q.conn.PushToListTail(queuePendingKey, g.MsgID)
+}
+
+func (q *redisQueue) Len() (int, error) {
+	l, err := q.conn.ListLength(queuePendingKey)
+	return int(l), err
+}
+
+func (q *redisQueue) Durable() bool {
+	return true
+}
@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+//durableQueue is a memoryQueue claiming to survive restarts.
+type durableQueue struct {
+	memoryQueue
+}
+
+func (q *durableQueue) Durable() bool {
+	return true
+}
+
+func testServer(queue requestQueue, online bool) *Server {
+	srv := &Server{OfflineAfter: time.Minute}
+	srv.asyncs.queue = queue
+	srv.asyncs.notify = make(chan struct{}, 1)
+	srv.presence = newPresence()
+	srv.listening = 1
+	if !online {
+		srv.presence.started = time.Now().Add(-time.Hour)
+	}
+	return srv
+}
+
+func TestWaitForClientsideProcessingQueued(t *testing.T) {
+	memory := func() requestQueue {
+		return &memoryQueue{processing: map[string]*rpc.Generic{}}
+	}
+	durable := func() requestQueue {
+		return &durableQueue{memoryQueue{processing: map[string]*rpc.Generic{}}}
+	}
+
+	tests := []struct {
+		name    string
+		queue   func() requestQueue
+		online  bool
+		path    string
+		want    error
+		pending int
+	}{
+		{"offline memory queue", memory, false, rpc.PathRegisterSickLeave, ErrClientOffline, 0},
+		{"offline durable queue", durable, false, rpc.PathRegisterSickLeave, ErrQueued, 1},
+		{"offline durable queue, other path", durable, false, "other", ErrClientOffline, 0},
+		{"timeout memory queue", memory, true, rpc.PathRegisterSickLeave,
+			context.DeadlineExceeded, 1},
+		{"timeout durable queue", durable, true, rpc.PathRegisterSickLeave, ErrQueued, 1},
+	}
+	for _, test := range tests {
+		srv := testServer(test.queue(), test.online)
+		_, err := srv.WaitForClientsideProcessing(
+			&rpc.Generic{Path: test.path},
+			10*time.Millisecond,
+		)
+		if err != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		if n, _ := srv.asyncs.queue.Len(); n != test.pending {
+			t.Errorf("%s: %d requests pending, want %d", test.name, n, test.pending)
+		}
+	}
+}
+
+func TestMemoryQueueRequeue(t *testing.T) {
+	q := &memoryQueue{processing: map[string]*rpc.Generic{}}
+	_ = q.Push(&rpc.Generic{MsgID: "a"})
+	taken, _ := q.Take()
+	_ = q.Push(&rpc.Generic{MsgID: "b"})
+	_ = q.Requeue(taken[0])
+
+	taken, _ = q.Take()
+	if len(taken) != 2 || taken[0].MsgID != "a" || taken[1].MsgID != "b" {
+		t.Fatalf("got %v, want requeued request first", taken)
+	}
+}
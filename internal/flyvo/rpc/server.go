@@ -3,14 +3,18 @@ package rpc
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/identity"
 	"github.com/tktip/flyvo-api/internal/redis"
+	"github.com/tktip/flyvo-api/internal/storage"
 	"github.com/tktip/flyvo-api/pkg/rpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -20,13 +24,51 @@ const (
 	defaultPort = "50051"
 )
 
+var (
+	//ErrQueued - the client did not respond in time, but the request is kept
+	//and will be delivered once the client connects.
+	ErrQueued = errors.New("request queued for delivery to flyvo client")
+
+	//ErrClientOffline - no flyvo client has been in contact recently, so the
+	//request was not attempted.
+	ErrClientOffline = errors.New("flyvo client offline")
+)
+
 //Server - the rpc server object
 type Server struct {
-	Port       string           `yaml:"port"`
-	CertFile   string           `yaml:"cert"`
-	KeyFile    string           `yaml:"key"`
-	Redis      *redis.Connector `yaml:"redis"`
-	Gcal       string           `yaml:"gcalUrl"`
+	Port     string           `yaml:"port"`
+	CertFile string           `yaml:"cert"`
+	KeyFile  string           `yaml:"key"`
+	Redis    *redis.Connector `yaml:"redis"`
+	Gcal     string           `yaml:"gcalUrl"`
+
+	//Store keeps the locations of events. Set by the api.
+	Store storage.Store `yaml:"-"`
+
+	//Identity maps visma participants to google accounts. Set by the api.
+	Identity *identity.Mapper `yaml:"-"`
+
+	//OnDelivered is called, in a goroutine of its own, with queued requests the
+	//client has responded to after the caller stopped waiting. Set by the api.
+	OnDelivered func(req *rpc.Generic, response *rpc.Generic) `yaml:"-"`
+
+	//TimeZone is the IANA time zone events are published in (default Europe/Oslo).
+	TimeZone string `yaml:"timeZone"`
+	//IncomingTimes decides how FlyVo timestamps are read, 'wallclock' or 'utc'.
+	IncomingTimes string `yaml:"incomingTimes"`
+	//Queue is where requests for the client are kept, 'memory' or 'redis'.
+	Queue string `yaml:"queue"`
+	//InFlightWindow is how many requests a client may process at the same time.
+	//Clients must echo msgID in their responses for a window larger than 1.
+	InFlightWindow int `yaml:"inFlightWindow"`
+	//IdleTimeout is how long an idle client is kept waiting for new requests.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	//OfflineAfter is how long since last contact before the client counts as offline.
+	OfflineAfter time.Duration `yaml:"offlineAfter"`
+
+	times      *timeConverter
+	presence   *presence
+	listening  int32
 	done       bool
 	wg         sync.WaitGroup
 	grpcServer *grpc.Server
@@ -37,6 +79,10 @@ type Server struct {
 
 //WaitForClientsideProcessing - Publish a request and wait for a response from the client
 //if timeout duration is passed, the request is canceled and an errorAndClose is returned.
+//Durable requests, absences and sick leave when the queue survives restarts, are
+//not canceled on timeout; they stay queued until the client has processed them,
+//and ErrQueued is returned instead. If no client has been seen
+//recently, ErrClientOffline is returned at once, or ErrQueued for durable requests.
 func (srv *Server) WaitForClientsideProcessing(
 	g *rpc.Generic,
 	timeout time.Duration,
@@ -44,36 +90,91 @@ func (srv *Server) WaitForClientsideProcessing(
 	rpc.Generic,
 	error,
 ) {
-	srv.asyncs.lock.Lock()
+	online := srv.Online()
+	if !online && !srv.isDurable(g) {
+		logrus.Warnf("No flyvo client seen for %s, rejecting '%s'", srv.offlineAfter(), g.Path)
+		requestFailures.Inc(g.Path, "offline")
+		return rpc.Generic{}, ErrClientOffline
+	}
+
+	start := time.Now()
+
+	g.MsgID = uuid.New().String()
 	reader := &genericReaderWriter{
-		id:      uuid.New().String(),
-		result:  make(chan *rpc.Generic),
-		err:     make(chan error),
+		id:      g.MsgID,
+		result:  make(chan *rpc.Generic, 1),
+		err:     make(chan error, 1),
 		generic: g,
 	}
-	srv.asyncs.readers = append(srv.asyncs.readers, reader)
-	srv.asyncs.lock.Unlock()
+	srv.asyncs.addReader(reader)
+	defer srv.asyncs.removeReader(reader.id)
+
+	err := srv.asyncs.queue.Push(g)
+	if err != nil {
+		logrus.Errorf("Failed to queue request: %s", err.Error())
+		requestFailures.Inc(g.Path, "queue")
+		return rpc.Generic{}, err
+	}
+	srv.asyncs.queued()
+
+	if !online {
+		logrus.Infof("%s: No flyvo client seen, '%s' stays queued for the client", g.MsgID, g.Path)
+		return rpc.Generic{}, ErrQueued
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	logrus.Debugf("Awaiting response from rpc client")
 	generic, err := reader.Read(ctx)
-	if err != nil {
+	if err == context.DeadlineExceeded && srv.isDurable(g) {
+		logrus.Infof("%s: No response yet, '%s' stays queued for the client", g.MsgID, g.Path)
+		requestFailures.Inc(g.Path, "timeout")
+		return rpc.Generic{}, ErrQueued
+	} else if err == context.DeadlineExceeded {
+		logrus.Debugf("Client side error: %s", err.Error())
+		requestFailures.Inc(g.Path, "timeout")
+		return rpc.Generic{}, err
+	} else if err == io.EOF {
 		logrus.Debugf("Client side error: %s", err.Error())
+		requestFailures.Inc(g.Path, "eof")
+		return rpc.Generic{}, err
+	} else if err != nil {
+		logrus.Debugf("Client side error: %s", err.Error())
+		requestFailures.Inc(g.Path, "error")
 		return rpc.Generic{}, err
 	}
 
+	requestDuration.Observe(time.Since(start).Seconds(), g.Path)
+
 	logrus.Debugf("Successfully retreived client side data")
 	return *generic, nil
 }
 
-func (srv *Server) init() (err error) {
+//Init - validates config and prepares the server. Must be called before Run, and
+//before any requests are published with WaitForClientsideProcessing.
+func (srv *Server) Init() (err error) {
 	if srv.Port == "" {
 		logrus.Warnf("No port provided, defaulting to '%s'", defaultPort)
 		srv.Port = defaultPort
 	}
 
+	srv.times, err = newTimeConverter(srv.TimeZone, srv.IncomingTimes)
+	if err != nil {
+		return err
+	}
+
+	srv.asyncs.queue, err = newRequestQueue(srv.Queue, srv.Redis)
+	if err != nil {
+		return err
+	}
+	srv.asyncs.notify = make(chan struct{}, 1)
+	srv.presence = newPresence()
+	queueDepth.SetFunc(func() float64 {
+		n, _ := srv.asyncs.queue.Len()
+		return float64(n)
+	})
+
 	if srv.KeyFile == "" && srv.CertFile == srv.KeyFile {
 		logrus.Info("No Cert/Key details. Running without certificate.")
 		return
@@ -105,20 +206,30 @@ func (srv *Server) listen() {
 		srv.grpcServer = grpc.NewServer(srv.opts...)
 		logrus.Infof("Listening for connections on: '%s'", lis.Addr().String())
 		rpc.RegisterTipFlyvoServer(srv.grpcServer, srv)
+		atomic.StoreInt32(&srv.listening, 1)
 		if err := srv.grpcServer.Serve(lis); err != nil {
 			logrus.Fatalf("failed to serve: %v", err)
 		}
+		atomic.StoreInt32(&srv.listening, 0)
 		srv.wg.Done()
 	}
 }
 
-//Run - starts the web api
-func (srv *Server) Run(ctx context.Context) {
+//CheckListener - returns an error unless the grpc server accepts connections
+func (srv *Server) CheckListener() error {
+	if atomic.LoadInt32(&srv.listening) == 0 {
+		return errors.New("grpc server not listening")
+	}
 
-	err := srv.init()
+	conn, err := net.DialTimeout("tcp", "localhost:"+srv.Port, time.Second)
 	if err != nil {
-		logrus.Fatalf("Failed to initialize: %s", err.Error())
+		return err
 	}
+	return conn.Close()
+}
+
+//Run - starts the web api
+func (srv *Server) Run(ctx context.Context) {
 	go srv.listen()
 
 	select {
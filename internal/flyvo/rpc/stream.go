@@ -0,0 +1,263 @@
+package rpc
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+const (
+	defaultInFlightWindow = 1
+	defaultIdleTimeout    = 30 * time.Second
+)
+
+//clientStream keeps track of the requests sent to one connected flyvo client
+//that are awaiting a response. Requests are sent as they are queued, and the
+//responses are matched back to them by MsgID, so the client may respond in any
+//order. At most window requests are awaiting response at the same time.
+type clientStream struct {
+	srv      *Server
+	client   rpc.TipFlyvo_ProcessRequestsServer
+	clientID string
+
+	lock     sync.Mutex
+	inFlight map[string]*rpc.Generic
+
+	slots    chan struct{}
+	received chan struct{}
+	done     chan struct{}
+	stopper  sync.Once
+	err      error
+}
+
+func newClientStream(
+	srv *Server,
+	client rpc.TipFlyvo_ProcessRequestsServer,
+	clientID string,
+) *clientStream {
+	window := srv.InFlightWindow
+	if window <= 0 {
+		window = defaultInFlightWindow
+	}
+
+	return &clientStream{
+		srv:      srv,
+		client:   client,
+		clientID: clientID,
+		inFlight: map[string]*rpc.Generic{},
+		slots:    make(chan struct{}, window),
+		received: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+//run sends queued requests to the client until the connection fails, or until
+//the client has been idle, with no requests queued or awaiting response, for
+//the idle timeout.
+//revive:disable-next-line:cyclomatic
+func (s *clientStream) run() error {
+	go s.receive()
+
+	for {
+		requests, err := s.srv.asyncs.queue.Take()
+		if err != nil && len(requests) == 0 {
+			logrus.Errorf("Failed to retrieve queued requests: %s", err.Error())
+			s.stop(err)
+			return err
+		} else if err != nil {
+			logrus.Warnf("Retrieved only some queued requests: %s", err.Error())
+		}
+
+		if len(requests) > 0 {
+			logrus.Debugf("Processing %d end user requests", len(requests))
+		}
+
+		for i, req := range requests {
+			err = s.send(req)
+			if err != nil {
+				for _, unsent := range requests[i+1:] {
+					s.srv.fail(unsent, s.srv.asyncs.reader(unsent.MsgID), err)
+				}
+				s.stop(err)
+				return s.result()
+			}
+		}
+
+		if len(requests) > 0 {
+			continue
+		}
+
+		if s.idle() {
+			logrus.Debug("No new requests from users, waiting for more")
+			timer := time.NewTimer(s.srv.idleTimeout())
+			select {
+			case <-s.srv.asyncs.notify:
+				timer.Stop()
+				continue
+			case <-timer.C:
+				logrus.Debug("No new requests from users")
+				return nil
+			case <-s.done:
+				timer.Stop()
+				return s.result()
+			}
+		}
+
+		select {
+		case <-s.srv.asyncs.notify:
+		case <-s.received:
+		case <-s.done:
+			return s.result()
+		}
+	}
+}
+
+//send sends a single request to the client, once there is room in the window.
+func (s *clientStream) send(req *rpc.Generic) error {
+	reqID := req.MsgID
+	logrus.Debugf("%s: Processing req.", reqID)
+
+	writer := s.srv.asyncs.reader(reqID)
+	if writer == nil && !s.srv.isDurable(req) {
+		logrus.Debugf("%s: Caller no longer waiting, dropping request.", reqID)
+		s.srv.ack(req)
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-s.done:
+		logrus.Debugf("%s: Connection was closed.", reqID)
+		s.srv.fail(req, writer, s.err)
+		return s.err
+	}
+
+	s.lock.Lock()
+	s.inFlight[reqID] = req
+	s.lock.Unlock()
+
+	logrus.Debugf("%s: Sending request to client", reqID)
+	err := s.client.Send(req)
+	if err != nil {
+		logrus.Debugf("%s: Could not send request to client.", reqID)
+		if s.take(reqID) != nil {
+			s.srv.fail(req, writer, err)
+		}
+		return err
+	}
+
+	logrus.Debugf("%s: Awaiting client response...", reqID)
+	return nil
+}
+
+//receive reads responses from the client and delivers them to the callers
+//until the connection fails.
+func (s *clientStream) receive() {
+	for {
+		g, err := s.client.Recv()
+		if err == io.EOF {
+			logrus.Debug("Got io.EOF from client - seems connection is closed.")
+			streamErrors.Inc("eof")
+			s.stop(err)
+			return
+		} else if err != nil {
+			logrus.Warnf("Got error from client: %s", err.Error())
+			streamErrors.Inc("error")
+			s.stop(err)
+			return
+		}
+
+		s.srv.presence.touch(s.clientID)
+
+		req := s.match(g)
+		if req == nil {
+			logrus.Warnf("%s: Got response from client for unknown request", g.MsgID)
+			continue
+		}
+
+		logrus.Debugf("%s: Successfully got response from client.", req.MsgID)
+		s.srv.deliver(req, g)
+
+		select {
+		case s.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//match removes and returns the in-flight request the response belongs to.
+//Clients that do not echo MsgID can only be matched with a window of one.
+func (s *clientStream) match(g *rpc.Generic) *rpc.Generic {
+	if g.MsgID != "" {
+		return s.take(g.MsgID)
+	}
+
+	s.lock.Lock()
+	id := ""
+	for reqID := range s.inFlight {
+		if len(s.inFlight) == 1 {
+			id = reqID
+		}
+	}
+	s.lock.Unlock()
+
+	if id == "" {
+		return nil
+	}
+	return s.take(id)
+}
+
+//take removes the request from in-flight and frees its slot in the window.
+func (s *clientStream) take(id string) *rpc.Generic {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	req, ok := s.inFlight[id]
+	if !ok {
+		return nil
+	}
+	delete(s.inFlight, id)
+	<-s.slots
+	return req
+}
+
+func (s *clientStream) idle() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.inFlight) == 0
+}
+
+//stop marks the connection as failed, and fails every request still in flight.
+func (s *clientStream) stop(err error) {
+	s.stopper.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		inFlight := s.inFlight
+		s.inFlight = map[string]*rpc.Generic{}
+		s.lock.Unlock()
+		close(s.done)
+
+		for id, req := range inFlight {
+			logrus.Debugf("%s: Connection was closed.", id)
+			s.srv.fail(req, s.srv.asyncs.reader(id), err)
+		}
+	})
+}
+
+//result is the error to return from ProcessRequests once the stream has stopped.
+func (s *clientStream) result() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return srv.IdleTimeout
+}
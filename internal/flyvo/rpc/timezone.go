@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeZone = "Europe/Oslo"
+
+	//IncomingWallClock - FlyVo sends local wall clock time suffixed with 'Z' ("fake-UTC").
+	IncomingWallClock = "wallclock"
+
+	//IncomingUTC - FlyVo sends actual UTC timestamps.
+	IncomingUTC = "utc"
+)
+
+//timeConverter converts timestamps received from FlyVo to timestamps with the
+//correct offset for the configured time zone.
+type timeConverter struct {
+	loc      *time.Location
+	incoming string
+}
+
+//LoadTimeZone - loads the IANA time zone @zone, defaulting to Europe/Oslo
+func LoadTimeZone(zone string) (*time.Location, error) {
+	if zone == "" {
+		zone = defaultTimeZone
+	}
+
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load time zone '%s': %s", zone, err.Error())
+	}
+	return loc, nil
+}
+
+func newTimeConverter(zone string, incoming string) (*timeConverter, error) {
+	loc, err := LoadTimeZone(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	switch incoming {
+	case "":
+		incoming = IncomingWallClock
+	case IncomingWallClock, IncomingUTC:
+	default:
+		return nil, fmt.Errorf("unknown incoming time interpretation '%s'", incoming)
+	}
+
+	return &timeConverter{
+		loc:      loc,
+		incoming: incoming,
+	}, nil
+}
+
+//wallClockIn returns the instant at which the wall clock of t (ignoring its
+//location) is shown in loc. Ambiguous wall clock times (when clocks are turned
+//back) resolve to the earliest instant, i.e. the one still in summer time.
+//Non-existent wall clock times (when clocks are turned forward) are moved
+//forward by the length of the gap.
+func wallClockIn(t time.Time, loc *time.Location) time.Time {
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	asUTC := time.Date(y, mo, d, h, mi, s, t.Nanosecond(), time.UTC)
+
+	var (
+		found bool
+		best  time.Time
+	)
+
+	//Transitions in loc are never closer than a few hours, so the offsets
+	//in effect around the wall clock time cover every candidate.
+	for _, probe := range []time.Duration{-6 * time.Hour, 0, 6 * time.Hour} {
+		_, offset := asUTC.Add(probe).In(loc).Zone()
+		candidate := asUTC.Add(-time.Duration(offset) * time.Second).In(loc)
+		if !sameWallClock(candidate, asUTC) {
+			continue
+		}
+		if !found || candidate.Before(best) {
+			best = candidate
+			found = true
+		}
+	}
+
+	if found {
+		return best
+	}
+
+	//In the gap; use the offset in effect before the clocks were turned.
+	_, offset := asUTC.Add(-6 * time.Hour).In(loc).Zone()
+	return asUTC.Add(-time.Duration(offset) * time.Second).In(loc)
+}
+
+func sameWallClock(a, b time.Time) bool {
+	ay, amo, ad := a.Date()
+	ah, ami, as := a.Clock()
+	by, bmo, bd := b.Date()
+	bh, bmi, bs := b.Clock()
+	return ay == by && amo == bmo && ad == bd &&
+		ah == bh && ami == bmi && as == bs &&
+		a.Nanosecond() == b.Nanosecond()
+}
+
+//correctTime converts a timestamp from FlyVo into an RFC3339 timestamp with
+//the offset of the configured time zone. Unparseable input is returned as is.
+func (tc *timeConverter) correctTime(incorrect string) string {
+	if incorrect == "" {
+		return ""
+	}
+
+	t, err := time.Parse(time.RFC3339, incorrect)
+	if err != nil {
+		logrus.Errorf("BAD TIME '%s': %s", incorrect, err.Error())
+		return incorrect
+	}
+
+	if tc.incoming == IncomingUTC {
+		return t.In(tc.loc).Format(time.RFC3339Nano)
+	}
+	return wallClockIn(t, tc.loc).Format(time.RFC3339Nano)
+}
@@ -0,0 +1,95 @@
+package rpc
+
+import "testing"
+
+func TestCorrectTimeWallClock(t *testing.T) {
+	tc, err := newTimeConverter("Europe/Oslo", IncomingWallClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"winter", "2024-01-15T10:00:00Z", "2024-01-15T10:00:00+01:00"},
+		{"summer", "2024-07-01T10:00:00Z", "2024-07-01T10:00:00+02:00"},
+		{"before spring forward 2024", "2024-03-31T01:59:59Z", "2024-03-31T01:59:59+01:00"},
+		{"non-existent hour 2024", "2024-03-31T02:30:00Z", "2024-03-31T03:30:00+02:00"},
+		{"after spring forward 2024", "2024-03-31T03:00:00Z", "2024-03-31T03:00:00+02:00"},
+		{"before fall back 2024", "2024-10-27T01:59:59Z", "2024-10-27T01:59:59+02:00"},
+		{"ambiguous hour 2024", "2024-10-27T02:30:00Z", "2024-10-27T02:30:00+02:00"},
+		{"after fall back 2024", "2024-10-27T03:00:00Z", "2024-10-27T03:00:00+01:00"},
+		{"non-existent hour 2025", "2025-03-30T02:00:00Z", "2025-03-30T03:00:00+02:00"},
+		{"ambiguous hour 2025", "2025-10-26T02:00:00Z", "2025-10-26T02:00:00+02:00"},
+		{"after fall back 2025", "2025-10-26T04:15:00Z", "2025-10-26T04:15:00+01:00"},
+		{"non-existent hour 2026", "2026-03-29T02:45:00Z", "2026-03-29T03:45:00+02:00"},
+		{"ambiguous hour 2026", "2026-10-25T02:59:59Z", "2026-10-25T02:59:59+02:00"},
+		{"fractional seconds", "2026-06-01T08:00:00.5Z", "2026-06-01T08:00:00.5+02:00"},
+		{"offset ignored", "2024-01-15T10:00:00+05:00", "2024-01-15T10:00:00+01:00"},
+		{"empty", "", ""},
+		{"unparseable", "not a time", "not a time"},
+	}
+	for _, test := range tests {
+		got := tc.correctTime(test.in)
+		if got != test.want {
+			t.Errorf("%s: correctTime(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestCorrectTimeUTC(t *testing.T) {
+	tc, err := newTimeConverter("Europe/Oslo", IncomingUTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"winter", "2024-01-15T09:00:00Z", "2024-01-15T10:00:00+01:00"},
+		{"summer", "2024-07-01T08:00:00Z", "2024-07-01T10:00:00+02:00"},
+		{"spring forward 2024", "2024-03-31T01:00:00Z", "2024-03-31T03:00:00+02:00"},
+		{"last winter second 2024", "2024-03-31T00:59:59Z", "2024-03-31T01:59:59+01:00"},
+		{"first of ambiguous hour 2024", "2024-10-27T00:30:00Z", "2024-10-27T02:30:00+02:00"},
+		{"second of ambiguous hour 2024", "2024-10-27T01:30:00Z", "2024-10-27T02:30:00+01:00"},
+		{"spring forward 2025", "2025-03-30T01:00:00Z", "2025-03-30T03:00:00+02:00"},
+		{"first of ambiguous hour 2025", "2025-10-26T00:15:00Z", "2025-10-26T02:15:00+02:00"},
+		{"second of ambiguous hour 2025", "2025-10-26T01:15:00Z", "2025-10-26T02:15:00+01:00"},
+		{"offset respected", "2024-01-15T12:00:00+02:00", "2024-01-15T11:00:00+01:00"},
+	}
+	for _, test := range tests {
+		got := tc.correctTime(test.in)
+		if got != test.want {
+			t.Errorf("%s: correctTime(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestNewTimeConverter(t *testing.T) {
+	tests := []struct {
+		zone     string
+		incoming string
+		want     string
+		wantErr  bool
+	}{
+		{"", "", IncomingWallClock, false},
+		{"Europe/Oslo", IncomingUTC, IncomingUTC, false},
+		{"Europe/Oslo", "local", "", true},
+		{"Not/AZone", IncomingWallClock, "", true},
+	}
+	for _, test := range tests {
+		tc, err := newTimeConverter(test.zone, test.incoming)
+		if (err != nil) != test.wantErr {
+			t.Errorf("newTimeConverter(%q, %q) error = %v", test.zone, test.incoming, err)
+			continue
+		}
+		if err == nil && tc.incoming != test.want {
+			t.Errorf("newTimeConverter(%q, %q) incoming = %q, want %q",
+				test.zone, test.incoming, tc.incoming, test.want)
+		}
+	}
+}
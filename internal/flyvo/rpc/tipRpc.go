@@ -6,20 +6,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/calendarid"
+	"github.com/tktip/flyvo-api/internal/identity"
 	"github.com/tktip/flyvo-api/pkg/rpc"
 	"github.com/tktip/google-calendar/pkg/googlecal"
 )
 
-var (
-	invalidChars = regexp.MustCompile(`([a-z0-9])*`)
-)
+//errEventNotFound - the calendar has no event with the id
+var errEventNotFound = errors.New("event not found in calendar")
 
 const (
 	addEvent          = "event/create"
@@ -28,10 +27,6 @@ const (
 	removeParticipant = "event/participants/"
 )
 
-func sanitizeCalendarID(ID string) string {
-	return strings.Join(invalidChars.FindAllString(strings.ToLower(ID), -1), "")
-}
-
 //revive:disable:cyclomatic
 func (srv *Server) sendToGcal(
 	ctx context.Context,
@@ -44,13 +39,12 @@ func (srv *Server) sendToGcal(
 ) {
 
 	if event.ID != nil {
-		*event.ID = sanitizeCalendarID(*event.ID)
 		{
 			if event.End != nil && strings.HasSuffix(*event.End, "Z") {
-				*event.End = correctTime(*event.End)
+				*event.End = srv.times.correctTime(*event.End)
 			}
 			if event.Start != nil && strings.HasSuffix(*event.Start, "Z") {
-				*event.Start = correctTime(*event.Start)
+				*event.Start = srv.times.correctTime(*event.Start)
 			}
 		}
 	}
@@ -84,13 +78,16 @@ func (srv *Server) sendToGcal(
 	}
 
 	defer resp.Body.Close()
+	CountGcalResponse(endpoint, resp.StatusCode)
 	body, err = ioutil.ReadAll(resp.Body)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errEventNotFound
+	} else if resp.StatusCode != 200 {
 		err = fmt.Errorf("unexpected status [%s]: %s", resp.Status, body)
 		logrus.Errorf("Failed to create event: %s", err.Error())
 		return nil, err
@@ -102,14 +99,20 @@ func (srv *Server) sendToGcal(
 	}, nil
 }
 
-func getParticipantsAsMails(participants []*rpc.Participant) []string {
+//getParticipantsAsMails maps participants to google accounts. Participants
+//without a known account are left out.
+func (srv *Server) getParticipantsAsMails(participants []*rpc.Participant) []string {
 	mails := []string{}
 	for _, participant := range participants {
-		//trovo?
-		mail := strings.ToLower(fmt.Sprintf("%s%s%s@trovo.no",
-			participant.GivenName[:1],
-			participant.Surname[:1],
-			participant.VismaId))
+		mail, err := srv.Identity.Email(identity.Person{
+			GivenName: participant.GivenName,
+			Surname:   participant.Surname,
+			VismaID:   participant.VismaId,
+		})
+		if err != nil {
+			logrus.Warnf("Leaving out participant '%s': %s", participant.VismaId, err.Error())
+			continue
+		}
 		mails = append(mails, mail)
 	}
 	return mails
@@ -118,9 +121,10 @@ func getParticipantsAsMails(participants []*rpc.Participant) []string {
 // PublishEvent publishes event to google.
 func (srv *Server) PublishEvent(ctx context.Context, in *rpc.Event) (*rpc.Generic, error) {
 	logrus.Debugf("Received publishEvent: %+v", *in)
-	mails := getParticipantsAsMails(in.Participants)
+	mails := srv.getParticipantsAsMails(in.Participants)
+	eventID := calendarid.Encode(in.VismaActivityId)
 	gEvent := googlecal.Event{
-		ID:           &in.VismaActivityId,
+		ID:           &eventID,
 		Title:        &in.ActivityTitle,
 		Location:     &in.Location, //Consider in.Room
 		Start:        &in.From,
@@ -129,6 +133,7 @@ func (srv *Server) PublishEvent(ctx context.Context, in *rpc.Event) (*rpc.Generi
 		Participants: &mails,
 	}
 
+	srv.saveLocation(in)
 	return srv.sendToGcal(ctx, gEvent, http.MethodPost, addEvent)
 }
 
@@ -137,10 +142,11 @@ func (srv *Server) UpdateEvent(ctx context.Context, in *rpc.Event) (*rpc.Generic
 
 	logrus.Debugf("Received updateEvent: %+v", *in)
 
-	mails := getParticipantsAsMails(in.Participants)
+	mails := srv.getParticipantsAsMails(in.Participants)
 
+	eventID := calendarid.Encode(in.VismaActivityId)
 	gEvent := googlecal.Event{
-		ID:           &in.VismaActivityId,
+		ID:           &eventID,
 		Title:        &in.ActivityTitle,
 		Location:     &in.Location, //Consider in.Room
 		Start:        &in.From,
@@ -149,42 +155,66 @@ func (srv *Server) UpdateEvent(ctx context.Context, in *rpc.Event) (*rpc.Generic
 		Participants: &mails,
 	}
 
-	return srv.sendToGcal(ctx, gEvent, http.MethodPut, updateEvent)
+	srv.saveLocation(in)
+	resp, err := srv.sendToGcal(ctx, gEvent, http.MethodPut, updateEvent)
+	if err == errEventNotFound {
+		//Events published by earlier versions have the legacy id
+		eventID = calendarid.Legacy(in.VismaActivityId)
+		resp, err = srv.sendToGcal(ctx, gEvent, http.MethodPut, updateEvent)
+	}
+	return resp, err
 }
 
 // DeleteEvent performs event delete in google.
 func (srv *Server) DeleteEvent(ctx context.Context, in *rpc.String) (*rpc.Generic, error) {
 	logrus.Debugf("Received deleteEvent: %v", in.Value)
 
+	err := srv.deleteGcalEvent(ctx, calendarid.Encode(in.Value))
+	if err == errEventNotFound {
+		//Events published by earlier versions have the legacy id
+		err = srv.deleteGcalEvent(ctx, calendarid.Legacy(in.Value))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.Generic{
+		Body:   []byte(`ok`),
+		Status: http.StatusOK,
+	}, nil
+}
+
+//deleteGcalEvent deletes the calendar event with @eventID.
+func (srv *Server) deleteGcalEvent(ctx context.Context, eventID string) error {
 	client := &http.Client{}
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodDelete,
-		srv.Gcal+deleteEvent+sanitizeCalendarID(in.Value),
+		srv.Gcal+deleteEvent+eventID,
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer resp.Body.Close()
+	CountGcalResponse(deleteEvent, resp.StatusCode)
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Unexpected status '%s': %s", resp.Status, body)
+	if resp.StatusCode == http.StatusNotFound {
+		return errEventNotFound
+	} else if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected status '%s': %s", resp.Status, body)
 	}
-
-	return &rpc.Generic{
-		Body:   []byte(`ok`),
-		Status: http.StatusOK,
-	}, nil
+	return nil
 }
 
 // RemoveFromEvent performs event delete in google.
@@ -212,6 +242,8 @@ func (srv *Server) RemoveFromEvent(ctx context.Context, in *rpc.String) (*rpc.Ge
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	CountGcalResponse(removeParticipant, resp.StatusCode)
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -231,6 +263,7 @@ func (srv *Server) RemoveFromEvent(ctx context.Context, in *rpc.String) (*rpc.Ge
 // HandleGeneric responds to generic requests
 func (srv *Server) HandleGeneric(ctx context.Context, in *rpc.Generic) (*rpc.Generic, error) {
 	logrus.Debugf("Received generic: %+v", in)
+	srv.presence.seen(ctx)
 	if in.Path == ping {
 		return srv.ping(ctx, *in), nil
 	}
@@ -244,75 +277,61 @@ func (srv *Server) HandleGeneric(ctx context.Context, in *rpc.Generic) (*rpc.Gen
 // ProcessRequests processes requests from web clients.
 // I.e. the rpc server stocks up web client requests, and the rpc client retrieves and
 // processes them, and the response from the rpc client is proxied back to web client.
+// Requests are streamed to the client as they arrive, and responses are matched to
+// requests by MsgID, allowing several requests to be processed in parallel.
 // NOTE: This function is called remotely from the RPC client.
 func (srv *Server) ProcessRequests(client rpc.TipFlyvo_ProcessRequestsServer) error {
-	logrus.Debugf("Locking asyncs lock")
+	clientID := srv.presence.seen(client.Context())
+	srv.presence.streamOpened(clientID)
+	defer srv.presence.streamClosed(clientID)
 
-	//Retrieve any requests received from frontend
-	srv.asyncs.lock.Lock()
+	err := newClientStream(srv, client, clientID).run()
+	logrus.Debugf("Done with client processing of end user reuqests.")
+	return err
+}
 
-	//Just stop on no requests to process.
-	if len(srv.asyncs.readers) == 0 {
-		logrus.Debug("No new requests from users")
-		srv.asyncs.lock.Unlock()
-		return nil
-	}
+//deliver hands a response from the client to the waiting caller, if any.
+func (srv *Server) deliver(req *rpc.Generic, response *rpc.Generic) {
+	srv.ack(req)
 
-	//Grab readwriters
-	writers := map[string]*genericReaderWriter{}
-	for i := range srv.asyncs.readers {
-		writers[srv.asyncs.readers[i].id] = srv.asyncs.readers[i]
+	writer := srv.asyncs.reader(req.MsgID)
+	if writer != nil {
+		writer.writeAndClose(response)
+		return
 	}
-	srv.asyncs.readers = []*genericReaderWriter{}
-	logrus.Debugf("Unlocking asyncs lock")
-	srv.asyncs.lock.Unlock()
-
-	connClosed := false
-
-	logrus.Debugf("Processing %d end user requests", len(writers))
 
-	//Process requests
-	for reqID, writer := range writers {
-		logrus.Debugf("%s: Processing req.", reqID)
-
-		//if connection is closed, inform all readers
-		if connClosed {
-			logrus.Debugf("%s: Connection was closed.", reqID)
-			writer.errorAndClose(io.EOF)
-			continue
-		}
-
-		//Send request from api
-		logrus.Debugf("%s: Sending request to client", reqID)
-		err := client.Send(writer.generic)
-		if err != nil {
-			logrus.Debugf("%s: Could not send request to client.", reqID)
-			writer.errorAndClose(err)
-			continue
-		}
-
-		logrus.Debugf("%s: Awaiting client response...", reqID)
-
-		//Get response
-		g, err := client.Recv()
+	logrus.Infof("%s: Delivered queued '%s' request, client responded %d",
+		req.MsgID,
+		req.Path,
+		response.Status,
+	)
+	if srv.OnDelivered != nil {
+		go srv.OnDelivered(req, response)
+	}
+}
 
-		//connection closed on client side
-		if err == io.EOF {
-			logrus.Debugf("%s: Got io.EOF from client - seems connection is closed.", reqID)
-			connClosed = true
-		}
+//ack removes a processed request from the queue.
+func (srv *Server) ack(req *rpc.Generic) {
+	err := srv.asyncs.queue.Ack(req)
+	if err != nil {
+		logrus.Errorf("%s: Failed to remove request from queue: %s", req.MsgID, err.Error())
+	}
+}
 
-		if err != nil {
-			logrus.Warnf("%s: Got error from client: %s", err.Error(), reqID)
-			writer.errorAndClose(err)
-		} else {
-			logrus.Debugf("%s: Successfully got response from client.", reqID)
-			writer.writeAndClose(g)
+//fail handles a request that could not be processed. Durable requests are put
+//back in the queue to be retried on the next connection, while the caller of
+//any other request is given the error.
+func (srv *Server) fail(req *rpc.Generic, writer *genericReaderWriter, err error) {
+	if srv.isDurable(req) {
+		qErr := srv.asyncs.queue.Requeue(req)
+		if qErr != nil {
+			logrus.Errorf("%s: Failed to requeue request: %s", req.MsgID, qErr.Error())
 		}
-		logrus.Debugf("%s: Done processing.", reqID)
+		return
 	}
 
-	logrus.Debugf("Done with client processing of end user reuqests.")
-
-	return nil
+	srv.ack(req)
+	if writer != nil {
+		writer.errorAndClose(err)
+	}
 }
@@ -2,10 +2,15 @@ package googletrovo
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/googleapi"
@@ -18,6 +23,9 @@ type Connector struct {
 	AdminUser    string `yaml:"adminUser"`
 	TeacherGroup string `yaml:"teacherGroup"`
 	service      *admin.MembersService
+	users        *admin.UsersService
+	tokens       oauth2.TokenSource
+	tokenLock    sync.Mutex
 }
 
 func (c *Connector) getMemberService() *admin.MembersService {
@@ -42,9 +50,122 @@ func (c *Connector) getMemberService() *admin.MembersService {
 	return c.service
 }
 
+func (c *Connector) getUserService() *admin.UsersService {
+	if c.users != nil {
+		return c.users
+	}
+
+	config, err := google.JWTConfigFromJSON([]byte(c.Creds),
+		admin.AdminDirectoryUserReadonlyScope,
+	)
+	if err != nil {
+		log.Fatalf("Could not read directory credentials => {%s}", err)
+	}
+
+	config.Subject = c.AdminUser
+
+	service, err := admin.NewService(
+		context.Background(), option.WithHTTPClient(config.Client(context.Background())))
+	if err != nil {
+		log.Fatalf("Could not create directory service client => {%s}", err)
+	}
+
+	c.users = admin.NewUsersService(service)
+	return c.users
+}
+
+//CustomAttribute - returns the value of custom schema attribute schema.field for
+//user, or an empty string if the user or attribute does not exist
+func (c *Connector) CustomAttribute(email string, schema string, field string) (string, error) {
+	user, err := c.getUserService().Get(email).
+		Projection("custom").
+		CustomFieldMask(schema).
+		Do()
+	if err != nil {
+		gerr, isGoogleAPIErr := err.(*googleapi.Error)
+		if isGoogleAPIErr && gerr.Code == http.StatusNotFound {
+			logrus.Errorf("User seems to not exist in google: %s", email)
+			return "", nil
+		}
+		return "", err
+	}
+
+	return customAttribute(user, schema, field)
+}
+
+//FindByCustomAttribute - returns the primary email of the user with custom schema
+//attribute schema.field set to value, or an empty string if there is none
+func (c *Connector) FindByCustomAttribute(schema string, field string, value string) (
+	string,
+	error,
+) {
+	users, err := c.getUserService().List().
+		Customer("my_customer").
+		Query(fmt.Sprintf("%s.%s='%s'", schema, field, strings.Replace(value, "'", "", -1))).
+		MaxResults(2).
+		Do()
+	if err != nil {
+		return "", err
+	}
+
+	if len(users.Users) == 0 {
+		return "", nil
+	} else if len(users.Users) > 1 {
+		return "", fmt.Errorf("several users have %s.%s '%s'", schema, field, value)
+	}
+	return users.Users[0].PrimaryEmail, nil
+}
+
+func customAttribute(user *admin.User, schema string, field string) (string, error) {
+	raw, ok := user.CustomSchemas[schema]
+	if !ok {
+		return "", nil
+	}
+
+	fields := map[string]interface{}{}
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return "", err
+	}
+
+	val, ok := fields[field]
+	if !ok {
+		return "", nil
+	}
+	return fmt.Sprint(val), nil
+}
+
+//CheckCredentials - returns an error unless the credentials can be exchanged for
+//a directory access token. Tokens are reused until they expire.
+func (c *Connector) CheckCredentials() error {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.tokens == nil {
+		config, err := google.JWTConfigFromJSON([]byte(c.Creds),
+			admin.AdminDirectoryGroupMemberReadonlyScope,
+			admin.AdminDirectoryGroupReadonlyScope,
+		)
+		if err != nil {
+			return err
+		}
+
+		config.Subject = c.AdminUser
+		c.tokens = config.TokenSource(context.Background())
+	}
+
+	_, err := c.tokens.Token()
+	return err
+}
+
 //IsMemberOfTeacherGroup - checks whether user is member of specified group
 func (c *Connector) IsMemberOfTeacherGroup(email string) (bool, error) {
-	l := c.getMemberService().HasMember(c.TeacherGroup, email)
+	return c.IsMemberOf(c.TeacherGroup, email)
+}
+
+//IsMemberOf - checks whether user is member of group
+func (c *Connector) IsMemberOf(group string, email string) (bool, error) {
+	l := c.getMemberService().HasMember(group, email)
 	m, err := l.Do()
 	if err != nil {
 		gerr, isGoogleAPIErr := err.(*googleapi.Error)
@@ -58,3 +179,20 @@ func (c *Connector) IsMemberOfTeacherGroup(email string) (bool, error) {
 	}
 	return m.IsMember, nil
 }
+
+//GroupMembers - returns the emails of the users in group, including members of
+//nested groups
+func (c *Connector) GroupMembers(group string) ([]string, error) {
+	var emails []string
+	err := c.getMemberService().List(group).
+		IncludeDerivedMembership(true).
+		Pages(context.Background(), func(page *admin.Members) error {
+			for _, member := range page.Members {
+				if member.Type == "USER" && member.Email != "" {
+					emails = append(emails, member.Email)
+				}
+			}
+			return nil
+		})
+	return emails, err
+}
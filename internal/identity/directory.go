@@ -0,0 +1,89 @@
+package identity
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-api/internal/googletrovo"
+)
+
+const (
+	directoryCacheTTL = time.Hour
+)
+
+type cachedValue struct {
+	value   string
+	expires time.Time
+}
+
+//directoryResolver maps identities using a custom schema attribute on users in
+//google directory. Lookups are cached.
+type directoryResolver struct {
+	trovo  *googletrovo.Connector
+	schema string
+	field  string
+
+	lock      sync.Mutex
+	byEmail   map[string]cachedValue
+	byVismaID map[string]cachedValue
+}
+
+func newDirectoryResolver(
+	trovo *googletrovo.Connector,
+	schema string,
+	field string,
+) *directoryResolver {
+	return &directoryResolver{
+		trovo:     trovo,
+		schema:    schema,
+		field:     field,
+		byEmail:   map[string]cachedValue{},
+		byVismaID: map[string]cachedValue{},
+	}
+}
+
+func (r *directoryResolver) cached(cache map[string]cachedValue, key string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	val, ok := cache[key]
+	if !ok || time.Now().After(val.expires) {
+		return "", false
+	}
+	return val.value, true
+}
+
+func (r *directoryResolver) cache(cache map[string]cachedValue, key string, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cache[key] = cachedValue{value: value, expires: time.Now().Add(directoryCacheTTL)}
+}
+
+func (r *directoryResolver) vismaID(email string) (string, error) {
+	if id, ok := r.cached(r.byEmail, email); ok {
+		return id, nil
+	}
+
+	id, err := r.trovo.CustomAttribute(email, r.schema, r.field)
+	if err != nil {
+		return "", err
+	}
+	r.cache(r.byEmail, email, id)
+	return id, nil
+}
+
+func (r *directoryResolver) email(p Person) (string, error) {
+	if p.VismaID == "" {
+		return "", nil
+	}
+
+	if mail, ok := r.cached(r.byVismaID, p.VismaID); ok {
+		return mail, nil
+	}
+
+	mail, err := r.trovo.FindByCustomAttribute(r.schema, r.field, p.VismaID)
+	if err != nil {
+		return "", err
+	}
+	r.cache(r.byVismaID, p.VismaID, mail)
+	return mail, nil
+}
@@ -0,0 +1,139 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/googletrovo"
+)
+
+const (
+	//ResolverPrefix - visma ID is the mailbox without the two initials
+	ResolverPrefix = "prefix"
+
+	//ResolverDirectory - visma ID is a custom schema attribute in google directory
+	ResolverDirectory = "directory"
+
+	//ResolverStatic - visma IDs are listed in a CSV or YAML file
+	ResolverStatic = "static"
+
+	defaultDomain = "trovo.no"
+)
+
+var (
+	//ErrUnknown - no resolver could map the identity
+	ErrUnknown = errors.New("no visma ID mapping for user")
+)
+
+//Person - a participant as known by visma
+type Person struct {
+	GivenName string
+	Surname   string
+	VismaID   string
+}
+
+//resolver maps between google accounts and visma IDs. Resolvers return empty
+//strings for identities they do not know.
+type resolver interface {
+	vismaID(email string) (string, error)
+	email(p Person) (string, error)
+}
+
+//Mapper - maps between google accounts and visma IDs, asking each configured
+//resolver in order until one knows the identity
+type Mapper struct {
+	//Resolvers to ask, in order. Defaults to [prefix], which must be last.
+	Resolvers []string `yaml:"resolvers"`
+
+	//Domain of mails built by the prefix resolver. Defaults to trovo.no.
+	Domain string `yaml:"domain"`
+
+	//Overrides is the path to a CSV or YAML file used by the static resolver.
+	Overrides string `yaml:"overrides"`
+
+	//Directory is the custom schema attribute used by the directory resolver.
+	Directory struct {
+		Schema string `yaml:"schema"`
+		Field  string `yaml:"field"`
+	} `yaml:"directory"`
+
+	resolvers []resolver
+}
+
+//Init - sets up the configured resolvers
+func (m *Mapper) Init(trovo *googletrovo.Connector) error {
+	if len(m.Resolvers) == 0 {
+		m.Resolvers = []string{ResolverPrefix}
+	}
+	if m.Domain == "" {
+		m.Domain = defaultDomain
+	}
+
+	m.resolvers = nil
+	for i, name := range m.Resolvers {
+		switch name {
+		case ResolverPrefix:
+			//It builds a mail for anyone with names, so it would shadow the
+			//resolvers after it.
+			if i != len(m.Resolvers)-1 {
+				return errors.New("prefix resolver must be the last resolver")
+			}
+			m.resolvers = append(m.resolvers, &prefixResolver{domain: m.Domain})
+		case ResolverStatic:
+			r, err := loadStaticResolver(m.Overrides)
+			if err != nil {
+				return err
+			}
+			m.resolvers = append(m.resolvers, r)
+		case ResolverDirectory:
+			if m.Directory.Schema == "" || m.Directory.Field == "" {
+				return errors.New("directory resolver requires schema and field")
+			}
+			m.resolvers = append(m.resolvers, newDirectoryResolver(
+				trovo,
+				m.Directory.Schema,
+				m.Directory.Field,
+			))
+		default:
+			return fmt.Errorf("unknown identity resolver '%s'", name)
+		}
+	}
+
+	logrus.Infof("Mapping identities with resolvers %v", m.Resolvers)
+	return nil
+}
+
+//VismaID - returns the visma ID of the user with email, or ErrUnknown
+func (m *Mapper) VismaID(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	for i, r := range m.resolvers {
+		id, err := r.vismaID(email)
+		if err != nil {
+			return "", fmt.Errorf("%s resolver: %s", m.Resolvers[i], err.Error())
+		}
+		if id != "" {
+			return id, nil
+		}
+	}
+
+	logrus.Warnf("No visma ID found for '%s'", email)
+	return "", ErrUnknown
+}
+
+//Email - returns the google account of a visma participant, or ErrUnknown
+func (m *Mapper) Email(p Person) (string, error) {
+	for i, r := range m.resolvers {
+		mail, err := r.email(p)
+		if err != nil {
+			return "", fmt.Errorf("%s resolver: %s", m.Resolvers[i], err.Error())
+		}
+		if mail != "" {
+			return strings.ToLower(mail), nil
+		}
+	}
+
+	logrus.Warnf("No email found for visma ID '%s'", p.VismaID)
+	return "", ErrUnknown
+}
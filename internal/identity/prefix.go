@@ -0,0 +1,49 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//prefixResolver maps mails on the form <initials><visma ID>@domain, e.g. pål
+//testesen with visma ID 12345 is pt12345@domain.
+type prefixResolver struct {
+	domain string
+}
+
+//vismaID returns the visma ID of mails on the form, and nothing for other mails.
+func (r *prefixResolver) vismaID(email string) (string, error) {
+	split := strings.Split(email, "@")
+	if len(split) != 2 || split[1] != r.domain {
+		return "", nil
+	}
+
+	local := []rune(split[0])
+	if len(local) < 3 || !unicode.IsLetter(local[0]) || !unicode.IsLetter(local[1]) {
+		return "", nil
+	}
+	for _, c := range local[2:] {
+		if c < '0' || c > '9' {
+			return "", nil
+		}
+	}
+	return string(local[2:]), nil
+}
+
+//email builds the mail of anyone with names and a visma ID, whether or not the
+//account exists, so the prefix resolver is only asked after the others.
+func (r *prefixResolver) email(p Person) (string, error) {
+	given := []rune(p.GivenName)
+	sur := []rune(p.Surname)
+	if len(given) == 0 || len(sur) == 0 || p.VismaID == "" {
+		return "", nil
+	}
+
+	return strings.ToLower(fmt.Sprintf("%c%c%s@%s",
+		given[0],
+		sur[0],
+		p.VismaID,
+		r.domain,
+	)), nil
+}
@@ -0,0 +1,56 @@
+package identity
+
+import "testing"
+
+func TestPrefixResolverVismaID(t *testing.T) {
+	r := &prefixResolver{domain: "trovo.no"}
+
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"pt12345@trovo.no", "12345"},
+		{"øt12345@trovo.no", "12345"},
+		{"åø1@trovo.no", "1"},
+		{"pt@trovo.no", ""},
+		{"p1@trovo.no", ""},
+		{"pt12a45@trovo.no", ""},
+		{"ola.nordmann@trovo.no", ""},
+		{"p112345@trovo.no", ""},
+		{"pt12345@other.no", ""},
+		{"pt12345", ""},
+	}
+	for _, test := range tests {
+		got, err := r.vismaID(test.email)
+		if err != nil || got != test.want {
+			t.Errorf("vismaID(%q) = %q, %v, want %q", test.email, got, err, test.want)
+		}
+	}
+}
+
+func TestPrefixResolverRoundTrip(t *testing.T) {
+	r := &prefixResolver{domain: "trovo.no"}
+
+	email, err := r.email(Person{GivenName: "Øystein", Surname: "Tå", VismaID: "12345"})
+	if err != nil || email != "øt12345@trovo.no" {
+		t.Fatalf("email() = %q, %v", email, err)
+	}
+	id, err := r.vismaID(email)
+	if err != nil || id != "12345" {
+		t.Fatalf("vismaID(%q) = %q, %v", email, id, err)
+	}
+}
+
+func TestPrefixResolverLast(t *testing.T) {
+	m := &Mapper{Resolvers: []string{ResolverPrefix, ResolverDirectory}}
+	m.Directory.Schema = "visma"
+	m.Directory.Field = "id"
+	if err := m.Init(nil); err == nil {
+		t.Fatal("Init accepted prefix resolver before directory resolver")
+	}
+
+	m = &Mapper{Resolvers: []string{ResolverPrefix}}
+	if err := m.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+}
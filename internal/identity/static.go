@@ -0,0 +1,92 @@
+package identity
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//staticEntry - one line of the overrides file
+type staticEntry struct {
+	Email   string `yaml:"email"`
+	VismaID string `yaml:"vismaId"`
+}
+
+//staticResolver maps identities listed in a file, either CSV with the columns
+//email,vismaId or YAML with a list of {email, vismaId}.
+type staticResolver struct {
+	byEmail   map[string]string
+	byVismaID map[string]string
+}
+
+func loadStaticResolver(path string) (*staticResolver, error) {
+	if path == "" {
+		return nil, errors.New("static resolver requires overrides file")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity overrides: %s", err.Error())
+	}
+
+	var entries []staticEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &entries)
+	case ".csv":
+		entries, err = parseCSVEntries(string(data))
+	default:
+		err = errors.New("overrides must be .csv, .yml or .yaml")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity overrides: %s", err.Error())
+	}
+
+	r := &staticResolver{
+		byEmail:   map[string]string{},
+		byVismaID: map[string]string{},
+	}
+	for _, e := range entries {
+		email := strings.ToLower(strings.TrimSpace(e.Email))
+		id := strings.TrimSpace(e.VismaID)
+		if email == "" || id == "" {
+			continue
+		}
+		r.byEmail[email] = id
+		r.byVismaID[id] = email
+	}
+	return r, nil
+}
+
+func parseCSVEntries(data string) ([]staticEntry, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []staticEntry
+	for i, record := range records {
+		//Optional header
+		if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "email") {
+			continue
+		}
+		entries = append(entries, staticEntry{Email: record[0], VismaID: record[1]})
+	}
+	return entries, nil
+}
+
+func (r *staticResolver) vismaID(email string) (string, error) {
+	return r.byEmail[email], nil
+}
+
+func (r *staticResolver) email(p Person) (string, error) {
+	return r.byVismaID[p.VismaID], nil
+}
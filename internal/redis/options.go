@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-redis/redis"
+)
+
+//Sentinel - redis behind sentinels, which point to the current master
+type Sentinel struct {
+	//Master is the name of the master set monitored by the sentinels.
+	Master string `yaml:"master"`
+	//Addrs are the host:port addresses of the sentinels.
+	Addrs []string `yaml:"addrs"`
+}
+
+//Cluster - a redis cluster
+type Cluster struct {
+	//Addrs are the host:port addresses of some of the nodes, the rest are found
+	//from them.
+	Addrs []string `yaml:"addrs"`
+}
+
+//TLS - encryption of the connections to redis
+type TLS struct {
+	Enabled bool `yaml:"enabled"`
+	//CA is the file with the certificates to trust, instead of the system ones.
+	CA string `yaml:"ca"`
+	//ServerName is the name to verify, if not the host of the address.
+	ServerName string `yaml:"serverName"`
+	//InsecureSkipVerify disables verifying the certificate. Only for testing.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+//config returns the tls config, or nil if tls is not enabled.
+func (t *TLS) config() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis CA: %s", err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in redis CA '%s'", t.CA)
+		}
+	}
+	return config, nil
+}
+
+//auth returns the password and db go-redis should select on connect, and a
+//hook authenticating as the user instead, if one is set. The AUTH of go-redis
+//only sends the password, so users (redis 6 ACL) authenticate, and then select
+//the db, once connected.
+func (r *Connector) auth() (string, int, func(*redis.Conn) error) {
+	if r.Username == "" {
+		return r.Password, r.Db, nil
+	}
+	return "", 0, func(conn *redis.Conn) error {
+		err := conn.Do("AUTH", r.Username, r.Password).Err()
+		if err != nil || r.Db == 0 {
+			return err
+		}
+		return conn.Select(r.Db).Err()
+	}
+}
+
+//newClient creates the client of the configured topology: a single instance,
+//a master found through sentinels, or a cluster.
+func (r *Connector) newClient() (redis.UniversalClient, error) {
+	tlsConfig, err := r.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	password, db, onConnect := r.auth()
+
+	switch {
+	case r.Sentinel.Master != "" && len(r.Cluster.Addrs) > 0:
+		return nil, errors.New("redis can not use both sentinel and cluster")
+	case r.Sentinel.Master != "":
+		if len(r.Sentinel.Addrs) == 0 {
+			return nil, errors.New("no redis sentinel addresses")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    r.Sentinel.Master,
+			SentinelAddrs: r.Sentinel.Addrs,
+			OnConnect:     onConnect,
+			Password:      password,
+			DB:            db,
+			PoolSize:      r.PoolSize,
+			MinIdleConns:  r.MinIdleConns,
+			TLSConfig:     tlsConfig,
+		}), nil
+	case len(r.Cluster.Addrs) > 0:
+		if r.Db != 0 {
+			return nil, errors.New("redis cluster only has db 0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        r.Cluster.Addrs,
+			OnConnect:    onConnect,
+			Password:     password,
+			PoolSize:     r.PoolSize,
+			MinIdleConns: r.MinIdleConns,
+			TLSConfig:    tlsConfig,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         r.URL,
+			OnConnect:    onConnect,
+			Password:     password,
+			DB:           db,
+			PoolSize:     r.PoolSize,
+			MinIdleConns: r.MinIdleConns,
+			TLSConfig:    tlsConfig,
+		}), nil
+	}
+}
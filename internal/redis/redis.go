@@ -1,26 +1,142 @@
 package redis
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/pkg/metrics"
 )
 
-//Connector provides access to redis
+//KeyPrefix - prefix of every key, included in the keys returned by GetList
+const KeyPrefix = "flyvo-"
+
+//scanCount is how many keys each SCAN call looks at.
+const scanCount = 1000
+
+var (
+	redisErrors = metrics.NewCounter(
+		"flyvo_redis_errors_total",
+		"Failed redis calls, per operation.",
+		"op",
+	)
+)
+
+//countError counts err, if any, as a failed call of op and returns it.
+func countError(op string, err error) error {
+	if err != nil && err != redis.Nil {
+		redisErrors.Inc(op)
+	}
+	return err
+}
+
+//Connector provides access to redis. Calls share a pool of connections,
+//created on first use. Redis is a single instance at URL, unless Sentinel or
+//Cluster is configured.
 type Connector struct {
 	URL      string        `yaml:"url"`
 	Db       int           `yaml:"db"`
 	Password string        `yaml:"password"`
 	RedisTTL time.Duration `yaml:"ttl"`
+
+	//Username is the ACL user to authenticate as, with Password.
+	Username string   `yaml:"username"`
+	Sentinel Sentinel `yaml:"sentinel"`
+	Cluster  Cluster  `yaml:"cluster"`
+	TLS      TLS      `yaml:"tls"`
+
+	//PoolSize is the most connections kept open. Defaults to 10 per CPU.
+	PoolSize int `yaml:"poolSize"`
+	//MinIdleConns is the number of idle connections kept open.
+	MinIdleConns int `yaml:"minIdleConns"`
+
+	lock   sync.Mutex
+	client redis.UniversalClient
+
+	//parent is the connector whose pool is used, if made by WithContext.
+	parent *Connector
+	ctx    context.Context
 }
 
-func (r *Connector) getConnection() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     r.URL,
-		Password: r.Password, // no password set
-		DB:       r.Db,
-	})
+//WithContext - returns a connector sharing the pool of @r, whose calls fail
+//once @ctx is done. Commands already sent are not cancelled.
+func (r *Connector) WithContext(ctx context.Context) *Connector {
+	root := r
+	if r.parent != nil {
+		root = r.parent
+	}
+
+	//Only the TTL is read from the connector itself, the pool is the parent's
+	return &Connector{
+		RedisTTL: root.RedisTTL,
+		parent:   root,
+		ctx:      ctx,
+	}
+}
+
+//pool returns the pooled client, creating it on first use.
+func (r *Connector) pool() (redis.UniversalClient, error) {
+	if r.parent != nil {
+		return r.parent.pool()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == nil {
+		client, err := r.newClient()
+		if err != nil {
+			return nil, err
+		}
+		r.client = client
+	}
+	return r.client, nil
+}
+
+//getConnection returns the pooled client, or the error of the context if it
+//is done.
+func (r *Connector) getConnection() (redis.UniversalClient, error) {
+	client, err := r.pool()
+	if err != nil || r.ctx == nil {
+		return client, err
+	} else if err = r.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.WithContext(r.ctx), nil
+	case *redis.ClusterClient:
+		return c.WithContext(r.ctx), nil
+	}
+	return client, nil
+}
+
+//Close - closes the connections of the pool. Connectors made by WithContext
+//share the pool, so closing them does nothing.
+func (r *Connector) Close() error {
+	if r.parent != nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+//Ping - checks that redis responds
+func (r *Connector) Ping() error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+	return countError("ping", client.Ping().Err())
 }
 
 /*
@@ -32,15 +148,17 @@ func (r *Connector) WriteValue(key string, value string, TTL ...time.Duration) (
 		_TTL = TTL[0]
 	}
 
-	client := r.getConnection()
-	defer client.Close()
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
 
-	key = "flyvo-" + key
-	logrus.Info("Saving " + value + " to cache.")
+	key = KeyPrefix + key
+	logrus.Debugf("Saving value of '%s' to cache.", key)
 	redisStatus := client.Set(key, value, _TTL)
 	if redisStatus.Err() != nil && redisStatus.Err().Error() != "" {
 		logrus.Errorf("Could not write: %s", redisStatus.Err().Error())
-		return redisStatus.Err()
+		return countError("set", redisStatus.Err())
 	}
 
 	return nil
@@ -50,25 +168,26 @@ func (r *Connector) WriteValue(key string, value string, TTL ...time.Duration) (
 GetValue returns the value from redis of given key if exists
 */
 func (r *Connector) GetValue(key string) ([]byte, error) {
-	client := r.getConnection()
-	defer client.Close()
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
+	}
 
-	key = "flyvo-" + key
+	key = KeyPrefix + key
 
 	redisData := client.Get(key)
-	logrus.Info(redis.Nil.Error())
 	if redisData.Err() != nil && redisData.Err().Error() != "" &&
 		redis.Nil.Error() != redisData.Err().Error() {
 		logrus.Warn("Could not get data, error [" + redisData.Err().Error() + "]")
-		return nil, redisData.Err()
+		return nil, countError("get", redisData.Err())
 	}
 
 	byteData, err := redisData.Bytes()
 	if err != nil && redis.Nil != err {
-		logrus.Info("Error occured: " + err.Error())
-		return nil, err
+		logrus.Warn("Error occured: " + err.Error())
+		return nil, countError("get", err)
 	} else if redisData.Val() == "" {
-		logrus.Info("No value found")
+		logrus.Debugf("No value found for '%s'", key)
 		return nil, nil
 
 	}
@@ -79,21 +198,103 @@ func (r *Connector) GetValue(key string) ([]byte, error) {
 	return byteData, nil
 }
 
+//PeekValue - returns the value of @key, or nil if it does not exist. Unlike
+//GetValue, the TTL of the key is left as is.
+func (r *Connector) PeekValue(key string) ([]byte, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := client.Get(KeyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return val, countError("get", err)
+}
+
+//Increment - increments the counter @key and returns the new value. The TTL is
+//set when the counter is created, so it expires @TTL after the first increment.
+func (r *Connector) Increment(key string, TTL time.Duration) (int64, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	key = KeyPrefix + key
+	val, err := client.Incr(key).Result()
+	if err != nil {
+		return 0, countError("incr", err)
+	}
+
+	if val == 1 {
+		err = client.Expire(key, TTL).Err()
+		if err != nil {
+			return val, countError("expire", err)
+		}
+	}
+	return val, nil
+}
+
+//scan returns the keys matching @pattern, from every master if clustered.
+func scan(client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(client, pattern)
+	}
+
+	var lock sync.Mutex
+	keys := []string{}
+	err := cluster.ForEachMaster(func(node *redis.Client) error {
+		found, err := scanNode(node, pattern)
+		lock.Lock()
+		defer lock.Unlock()
+		keys = append(keys, found...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+//scanNode returns the keys matching @pattern. It iterates with SCAN, so redis
+//is not blocked while the keyspace is searched.
+func scanNode(client redis.Cmdable, pattern string) ([]string, error) {
+	seen := map[string]bool{}
+	keys := []string{}
+	var cursor uint64
+	for {
+		batch, next, err := client.Scan(cursor, pattern, scanCount).Result()
+		if err != nil {
+			return nil, countError("scan", err)
+		}
+
+		//SCAN may return a key more than once
+		for _, key := range batch {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
 /*
-GetList returns a list of keys based on regex
+GetList returns a list of keys based on regex. It scans the whole keyspace, so
+prefer indexes (see WriteIndexed) for anything done often.
 */
 func (r *Connector) GetList(regex string) ([]string, error) {
-	client := r.getConnection()
-	defer client.Close()
-
-	regex = "flyvo-" + regex
-
-	cmd := client.Keys(regex)
-	cmd.Val()
-	if cmd.Err() != nil {
-		return nil, cmd.Err()
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
 	}
-	return cmd.Val(), nil
+
+	return scan(client, KeyPrefix+regex)
 }
 
 //GetStringValue - get string value of key
@@ -106,25 +307,328 @@ func (r *Connector) GetStringValue(key string) (string, error) {
 	return string(val), nil
 }
 
+//Publish - publishes @message on @channel
+func (r *Connector) Publish(channel string, message string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("publish", client.Publish(KeyPrefix+channel, message).Err())
+}
+
+//Subscribe - subscribes to @channel. Messages are delivered on the returned
+//channel until stop is called. The subscription holds a connection of its own.
+func (r *Connector) Subscribe(channel string) (messages <-chan string, stop func(), err error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	pubsub := client.Subscribe(KeyPrefix + channel)
+
+	//Wait for the subscription to be confirmed.
+	_, err = pubsub.Receive()
+	if err != nil {
+		pubsub.Close()
+		return nil, nil, countError("subscribe", err)
+	}
+
+	out := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for msg := range pubsub.Channel() {
+			select {
+			case out <- msg.Payload:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+			pubsub.Close()
+		})
+	}
+	return out, stop, nil
+}
+
+//DeleteValue - deletes @key
+func (r *Connector) DeleteValue(key string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("del", client.Del(KeyPrefix+key).Err())
+}
+
 //DeleteRegex - deletes all keys/values with regex match
 func (r *Connector) DeleteRegex(regex string) error {
 	logrus.Debugf("Deleting regex '%s' from redis", regex)
-	client := r.getConnection()
-	defer client.Close()
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	list, err := scan(client, KeyPrefix+regex)
+	if err != nil {
+		return err
+	}
+
+	//Deleted one by one, as a cluster can not delete keys of several slots at once
+	for len(list) > 0 {
+		batch := list
+		if len(batch) > scanCount {
+			batch = batch[:scanCount]
+		}
+		list = list[len(batch):]
+
+		_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, key := range batch {
+				pipe.Del(key)
+			}
+			return nil
+		})
+		if err != nil {
+			return countError("del", err)
+		}
+	}
+	return nil
+}
+
+//Index - a set of members, e.g. the participants of an activity, kept along
+//with the values they refer to so they can be read without scanning
+type Index struct {
+	Key    string
+	Member string
+}
 
-	list, err := r.GetList(regex)
+//WriteIndexed - writes @value to @key and adds the members to their indexes,
+//atomically. In a cluster, only keys in the same hash slot change atomically.
+func (r *Connector) WriteIndexed(
+	key string,
+	value string,
+	indexes []Index,
+	TTL ...time.Duration,
+) error {
+	_TTL := r.RedisTTL
+	if len(TTL) > 0 {
+		_TTL = TTL[0]
+	}
+
+	client, err := r.getConnection()
 	if err != nil {
 		return err
 	}
 
-	if len(list) == 0 {
+	logrus.Debugf("Saving value of '%s' to cache.", KeyPrefix+key)
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(KeyPrefix+key, value, _TTL)
+		for _, index := range indexes {
+			pipe.SAdd(KeyPrefix+index.Key, index.Member)
+		}
 		return nil
+	})
+	return countError("set", err)
+}
+
+//DeleteIndexed - deletes @keys and removes the members from their indexes,
+//atomically. In a cluster, only keys in the same hash slot change atomically.
+func (r *Connector) DeleteIndexed(keys []string, indexes ...Index) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
 	}
 
-	cmd := client.Del(list...)
-	if cmd.Err() != nil {
-		return cmd.Err()
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(KeyPrefix + key)
+		}
+		for _, index := range indexes {
+			pipe.SRem(KeyPrefix+index.Key, index.Member)
+		}
+		return nil
+	})
+	return countError("del", err)
+}
+
+//SetMembers - returns the members of set @key
+func (r *Connector) SetMembers(key string) ([]string, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	members, err := client.SMembers(KeyPrefix + key).Result()
+	return members, countError("smembers", err)
+}
+
+//AddToSet - adds @members to set @key. Sets do not expire.
+func (r *Connector) AddToSet(key string, members ...string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return countError("sadd", client.SAdd(KeyPrefix+key, values...).Err())
+}
+
+//RemoveFromSet - removes @members from set @key
+func (r *Connector) RemoveFromSet(key string, members ...string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return countError("srem", client.SRem(KeyPrefix+key, values...).Err())
+}
+
+//PeekValues - returns the values of @keys in one call, nil for keys that do
+//not exist. The TTLs of the keys are left as is.
+func (r *Connector) PeekValues(keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return [][]byte{}, nil
+	}
+
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	//Pipelined rather than MGET, as a cluster can not get keys of several slots at once
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(KeyPrefix + key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, countError("get", err)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, cmd := range cmds {
+		val, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, countError("get", err)
+		}
+		values[i] = val
+	}
+	return values, nil
+}
+
+//SetHashValue - sets @field of hash @key to @value. Hashes do not expire.
+func (r *Connector) SetHashValue(key string, field string, value []byte) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("hset", client.HSet(KeyPrefix+key, field, value).Err())
+}
+
+//GetHashValue - returns @field of hash @key, or nil if it does not exist
+func (r *Connector) GetHashValue(key string, field string) ([]byte, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := client.HGet(KeyPrefix+key, field).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return val, countError("hget", err)
+}
+
+//DeleteHashValue - deletes @field from hash @key
+func (r *Connector) DeleteHashValue(key string, field string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("hdel", client.HDel(KeyPrefix+key, field).Err())
+}
+
+//PushToList - adds @value to the head of list @key. Lists do not expire.
+func (r *Connector) PushToList(key string, value string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("lpush", client.LPush(KeyPrefix+key, value).Err())
+}
+
+//PushToListTail - adds @value to the tail of list @key. Lists do not expire.
+func (r *Connector) PushToListTail(key string, value string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("rpush", client.RPush(KeyPrefix+key, value).Err())
+}
+
+//ListValues - returns the values of list @key, from head to tail
+func (r *Connector) ListValues(key string) ([]string, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := client.LRange(KeyPrefix+key, 0, -1).Result()
+	return values, countError("lrange", err)
+}
+
+//MoveListTail - atomically moves the tail of list @src to the head of list @dst
+//and returns it. Returns an empty string if @src is empty.
+func (r *Connector) MoveListTail(src string, dst string) (string, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return "", err
+	}
+
+	val, err := client.RPopLPush(KeyPrefix+src, KeyPrefix+dst).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return val, countError("rpoplpush", err)
+}
+
+//RemoveFromList - removes all occurrences of @value from list @key
+func (r *Connector) RemoveFromList(key string, value string) error {
+	client, err := r.getConnection()
+	if err != nil {
+		return err
+	}
+
+	return countError("lrem", client.LRem(KeyPrefix+key, 0, value).Err())
+}
+
+//ListLength - returns the length of list @key
+func (r *Connector) ListLength(key string) (int64, error) {
+	client, err := r.getConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	l, err := client.LLen(KeyPrefix + key).Result()
+	return l, countError("llen", err)
 }
@@ -0,0 +1,423 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/internal/storage"
+)
+
+const (
+	activityPrefix      = "activity-"
+	teachersPrefix      = "teachers-"
+	participationPrefix = "participation-"
+	overridePrefix      = "override-"
+	auditPrefix         = "audit-"
+	rolesPrefix         = "roles-"
+	syncStatePrefix     = "absenteesync-"
+	syncRunPrefix       = "syncrun-"
+	attendancePrefix    = "attendance-"
+
+	//The indexes are sets of the ids kept under each prefix, so they can be
+	//read without scanning the keyspace.
+	activityIndex          = "index-activities"
+	participantIndexPrefix = "index-participants-"
+	overrideIndexPrefix    = "index-overrides-"
+	overriddenIndex        = "index-overridden"
+	syncStateIndex         = "index-absenteesyncs"
+	syncRunIndex           = "index-syncruns"
+)
+
+//Entry - a value kept per participant of an activity
+type Entry struct {
+	ActivityID string
+	Email      string
+	Value      []byte
+}
+
+//Repository - typed access to what the api keeps in storage, so the formats of
+//the keys are kept in one place. Activities and participations are keyed by
+//activity id, while overrides, their audit and sync states are keyed by the
+//calendar id of the activity. Each kind of value is indexed in sets written
+//along with it, so listing never scans the keyspace.
+type Repository struct {
+	store storage.Store
+}
+
+//New - returns a repository on top of @store
+func New(store storage.Store) *Repository {
+	return &Repository{store: store}
+}
+
+//WithContext - returns a repository sharing the connections of @r, whose calls
+//fail once @ctx is done
+func (r *Repository) WithContext(ctx context.Context) *Repository {
+	return &Repository{store: r.store.WithContext(ctx)}
+}
+
+//Ping - checks that the storage responds
+func (r *Repository) Ping() error {
+	return r.store.Ping()
+}
+
+//indexed returns the members of @index whose value under @prefix exists, with
+//the values. Members whose value has expired are dropped from the index if
+//@prune is set.
+func (r *Repository) indexed(index string, prefix string, prune bool) (
+	members []string,
+	values [][]byte,
+	err error,
+) {
+	all, err := r.store.SetMembers(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, len(all))
+	for i, member := range all {
+		keys[i] = prefix + member
+	}
+	stored, err := r.store.PeekValues(keys...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var expired []string
+	for i, value := range stored {
+		if value == nil {
+			expired = append(expired, all[i])
+			continue
+		}
+		members = append(members, all[i])
+		values = append(values, value)
+	}
+
+	if prune && len(expired) > 0 {
+		err = r.store.RemoveFromSet(index, expired...)
+		if err != nil {
+			logrus.Warnf("Failed to prune index '%s': %s", index, err.Error())
+		}
+	}
+	return members, values, nil
+}
+
+//entries returns the values kept per participant of the activity, indexed in
+//@index.
+func (r *Repository) entries(activityID string, index string, prefix string) ([]Entry, error) {
+	emails, values, err := r.indexed(index, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(emails))
+	for i, email := range emails {
+		entries[i] = Entry{
+			ActivityID: activityID,
+			Email:      email,
+			Value:      values[i],
+		}
+	}
+	return entries, nil
+}
+
+//deleteEntries deletes the values kept per participant of the activity,
+//indexed in @index, and the index itself.
+func (r *Repository) deleteEntries(
+	index string,
+	prefix string,
+	keys []string,
+	indexes ...storage.Index,
+) error {
+	emails, err := r.store.SetMembers(index)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		keys = append(keys, prefix+email)
+	}
+	return r.store.DeleteIndexed(append(keys, index), indexes...)
+}
+
+//AddActivity - marks the activity as held, so the absentee sync picks it up
+func (r *Repository) AddActivity(activityID string) error {
+	return r.store.WriteIndexed(activityPrefix+activityID, activityID, []storage.Index{
+		{Key: activityIndex, Member: activityID},
+	})
+}
+
+//Activities - returns the ids of the activities held
+func (r *Repository) Activities() ([]string, error) {
+	activities, _, err := r.indexed(activityIndex, activityPrefix, false)
+	return activities, err
+}
+
+//KnownActivities - returns the ids of the activities held, or with
+//participations, until they are deleted. Unlike Activities, this includes
+//activities that have expired.
+func (r *Repository) KnownActivities() ([]string, error) {
+	return r.store.SetMembers(activityIndex)
+}
+
+//AddTeacher - records @email as a teacher of the activity, who may correct its
+//attendance
+func (r *Repository) AddTeacher(activityID string, email string) error {
+	return r.store.AddToSet(teachersPrefix+activityID, strings.ToLower(email))
+}
+
+//IsTeacher - returns whether @email is recorded as a teacher of the activity
+func (r *Repository) IsTeacher(activityID string, email string) (bool, error) {
+	teachers, err := r.store.SetMembers(teachersPrefix + activityID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, teacher := range teachers {
+		if teacher == strings.ToLower(email) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//DeleteActivity - deletes the activity, its teachers and its participations
+func (r *Repository) DeleteActivity(activityID string) error {
+	return r.deleteEntries(
+		participantIndexPrefix+activityID,
+		participationPrefix+activityID+"-",
+		[]string{activityPrefix + activityID, teachersPrefix + activityID},
+		storage.Index{Key: activityIndex, Member: activityID},
+	)
+}
+
+func participationKey(activityID string, email string) string {
+	return participationPrefix + activityID + "-" + email
+}
+
+//Participation - returns the participation of @email in the activity, or nil
+//if there is none. Reading it keeps it from expiring.
+func (r *Repository) Participation(activityID string, email string) ([]byte, error) {
+	return r.store.GetValue(participationKey(activityID, email))
+}
+
+//SaveParticipation - registers the participation of @email in the activity
+func (r *Repository) SaveParticipation(activityID string, email string, value []byte) error {
+	return r.store.WriteIndexed(participationKey(activityID, email), string(value), []storage.Index{
+		{Key: participantIndexPrefix + activityID, Member: email},
+		{Key: activityIndex, Member: activityID},
+	})
+}
+
+//Participations - returns the participations registered in the activity
+func (r *Repository) Participations(activityID string) ([]Entry, error) {
+	return r.entries(
+		activityID,
+		participantIndexPrefix+activityID,
+		participationPrefix+activityID+"-",
+	)
+}
+
+func overrideKey(calendarID string, email string) string {
+	return overridePrefix + calendarID + "-" + email
+}
+
+//Override - returns the attendance override of @email in the activity, or nil
+//if there is none
+func (r *Repository) Override(calendarID string, email string) ([]byte, error) {
+	return r.store.PeekValue(overrideKey(calendarID, email))
+}
+
+//SaveOverride - sets the attendance override of @email in the activity
+func (r *Repository) SaveOverride(calendarID string, email string, value []byte) error {
+	return r.store.WriteIndexed(overrideKey(calendarID, email), string(value), []storage.Index{
+		{Key: overrideIndexPrefix + calendarID, Member: email},
+		{Key: overriddenIndex, Member: calendarID},
+	})
+}
+
+//DeleteOverride - deletes the attendance override of @email in the activity
+func (r *Repository) DeleteOverride(calendarID string, email string) error {
+	return r.store.DeleteIndexed(
+		[]string{overrideKey(calendarID, email)},
+		storage.Index{Key: overrideIndexPrefix + calendarID, Member: email},
+	)
+}
+
+//Overrides - returns the attendance overrides of the activity
+func (r *Repository) Overrides(calendarID string) ([]Entry, error) {
+	return r.entries(
+		calendarID,
+		overrideIndexPrefix+calendarID,
+		overridePrefix+calendarID+"-",
+	)
+}
+
+//OverriddenActivities - returns the calendar ids of the activities with
+//overrides, until they are deleted
+func (r *Repository) OverriddenActivities() ([]string, error) {
+	return r.store.SetMembers(overriddenIndex)
+}
+
+//DeleteOverrides - deletes the attendance overrides of the activity. The audit
+//is kept.
+func (r *Repository) DeleteOverrides(calendarID string) error {
+	return r.deleteEntries(
+		overrideIndexPrefix+calendarID,
+		overridePrefix+calendarID+"-",
+		nil,
+		storage.Index{Key: overriddenIndex, Member: calendarID},
+	)
+}
+
+//AppendAudit - adds @value to the audit of the overrides of the activity
+func (r *Repository) AppendAudit(calendarID string, value []byte) error {
+	return r.store.PushToList(auditPrefix+calendarID, string(value))
+}
+
+//Audit - returns the audit of the overrides of the activity, newest first
+func (r *Repository) Audit(calendarID string) ([]string, error) {
+	return r.store.ListValues(auditPrefix + calendarID)
+}
+
+//CachedRoles - returns the cached roles of @email, or nil if not cached
+func (r *Repository) CachedRoles(email string) ([]byte, error) {
+	return r.store.GetValue(rolesPrefix + email)
+}
+
+//CacheRoles - caches the roles of @email for @TTL
+func (r *Repository) CacheRoles(email string, value []byte, TTL time.Duration) error {
+	return r.store.WriteValue(rolesPrefix+email, string(value), TTL)
+}
+
+//ForgetRoles - drops the cached roles of @email
+func (r *Repository) ForgetRoles(email string) error {
+	return r.store.DeleteValue(rolesPrefix + email)
+}
+
+//SyncState - returns the absentee sync state of the activity, or nil if it
+//has none
+func (r *Repository) SyncState(calendarID string) ([]byte, error) {
+	return r.store.PeekValue(syncStatePrefix + calendarID)
+}
+
+//SaveSyncState - saves the absentee sync state of the activity for @TTL
+func (r *Repository) SaveSyncState(calendarID string, value []byte, TTL time.Duration) error {
+	return r.store.WriteIndexed(syncStatePrefix+calendarID, string(value), []storage.Index{
+		{Key: syncStateIndex, Member: calendarID},
+	}, TTL)
+}
+
+//SyncStates - returns the absentee sync states of every activity
+func (r *Repository) SyncStates() ([][]byte, error) {
+	_, states, err := r.indexed(syncStateIndex, syncStatePrefix, true)
+	return states, err
+}
+
+//SyncRun - returns the absentee sync run, or nil if there is none
+func (r *Repository) SyncRun(id string) ([]byte, error) {
+	return r.store.PeekValue(syncRunPrefix + id)
+}
+
+//SaveSyncRun - saves the absentee sync run for @TTL
+func (r *Repository) SaveSyncRun(id string, value []byte, TTL time.Duration) error {
+	return r.store.WriteIndexed(syncRunPrefix+id, string(value), []storage.Index{
+		{Key: syncRunIndex, Member: id},
+	}, TTL)
+}
+
+//SyncRuns - returns every absentee sync run
+func (r *Repository) SyncRuns() ([][]byte, error) {
+	_, runs, err := r.indexed(syncRunIndex, syncRunPrefix, true)
+	return runs, err
+}
+
+//PublishRegistration - notifies subscribers of the activity of a registration
+func (r *Repository) PublishRegistration(activityID string, value []byte) error {
+	return r.store.Publish(attendancePrefix+activityID, string(value))
+}
+
+//SubscribeRegistrations - delivers the registrations published in the activity
+//until stop is called
+func (r *Repository) SubscribeRegistrations(activityID string) (
+	registrations <-chan string,
+	stop func(),
+	err error,
+) {
+	return r.store.Subscribe(attendancePrefix + activityID)
+}
+
+//Reindex - adds values written before they were indexed to the indexes. It
+//scans the keyspace, so it is meant to run once, at start up. Stores that
+//cannot list their keys have nothing written before the indexes, and are left
+//as is.
+func (r *Repository) Reindex() error {
+	scanner, ok := r.store.(storage.Scanner)
+	if !ok {
+		return nil
+	}
+
+	split := func(id string) (string, string) {
+		parts := strings.SplitN(id, "-", 2)
+		if len(parts) != 2 {
+			return "", ""
+		}
+		return parts[0], parts[1]
+	}
+
+	indexers := map[string]func(id string) []storage.Index{
+		activityPrefix: func(id string) []storage.Index {
+			return []storage.Index{{Key: activityIndex, Member: id}}
+		},
+		participationPrefix: func(id string) []storage.Index {
+			activityID, email := split(id)
+			if email == "" {
+				return nil
+			}
+			return []storage.Index{
+				{Key: participantIndexPrefix + activityID, Member: email},
+				{Key: activityIndex, Member: activityID},
+			}
+		},
+		overridePrefix: func(id string) []storage.Index {
+			calendarID, email := split(id)
+			if email == "" {
+				return nil
+			}
+			return []storage.Index{
+				{Key: overrideIndexPrefix + calendarID, Member: email},
+				{Key: overriddenIndex, Member: calendarID},
+			}
+		},
+		syncStatePrefix: func(id string) []storage.Index {
+			return []storage.Index{{Key: syncStateIndex, Member: id}}
+		},
+		syncRunPrefix: func(id string) []storage.Index {
+			return []storage.Index{{Key: syncRunIndex, Member: id}}
+		},
+	}
+
+	members := map[string][]string{}
+	for prefix, indexer := range indexers {
+		keys, err := scanner.Keys(prefix + "*")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, prefix)
+			for _, index := range indexer(id) {
+				members[index.Key] = append(members[index.Key], index.Member)
+			}
+		}
+	}
+
+	for index, ids := range members {
+		err := r.store.AddToSet(index, ids...)
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Reindexed %d sets", len(members))
+	return nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//subscriberBuffer is how many messages a subscriber may fall behind before
+//messages to it are dropped.
+const subscriberBuffer = 64
+
+//broker delivers published messages to subscribers in the same process, for
+//stores without a pubsub of their own.
+type broker struct {
+	lock sync.Mutex
+	subs map[string]map[chan string]bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: map[string]map[chan string]bool{}}
+}
+
+//Publish delivers @message to the subscribers of @channel.
+func (b *broker) Publish(channel string, message string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for sub := range b.subs[channel] {
+		select {
+		case sub <- message:
+		default:
+			logrus.Warnf("Subscriber to '%s' is behind, dropping message", channel)
+		}
+	}
+	return nil
+}
+
+//Subscribe delivers the messages published on @channel until stop is called.
+func (b *broker) Subscribe(channel string) (messages <-chan string, stop func(), err error) {
+	sub := make(chan string, subscriberBuffer)
+
+	b.lock.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = map[chan string]bool{}
+	}
+	b.subs[channel][sub] = true
+	b.lock.Unlock()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			delete(b.subs[channel], sub)
+			if len(b.subs[channel]) == 0 {
+				delete(b.subs, channel)
+			}
+			close(sub)
+		})
+	}
+	return sub, stop, nil
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultFilePath = "flyvo-state.json"
+
+//File - state kept in a file, for small single node deployments and local
+//development. The whole file is rewritten on every change, but not when a
+//read resets the TTL of a value.
+type File struct {
+	//Path of the file. Defaults to flyvo-state.json.
+	Path string `yaml:"path"`
+}
+
+//fileValue - a value in the file, and when it expires
+type fileValue struct {
+	Value   string     `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (v fileValue) expired(now time.Time) bool {
+	return v.Expires != nil && !now.Before(*v.Expires)
+}
+
+//fileData - the contents of the file
+type fileData struct {
+	Values map[string]fileValue       `json:"values"`
+	Sets   map[string]map[string]bool `json:"sets"`
+	Lists  map[string][]string        `json:"lists"`
+}
+
+//fileStore is a Store kept in a file. Messages are only published to
+//subscribers in the same process.
+type fileStore struct {
+	*broker
+
+	lock sync.Mutex
+	path string
+	ttl  time.Duration
+	data fileData
+}
+
+func (f *File) open(ttl time.Duration) (Store, error) {
+	s := &fileStore{
+		broker: newBroker(),
+		path:   f.Path,
+		ttl:    ttl,
+		data: fileData{
+			Values: map[string]fileValue{},
+			Sets:   map[string]map[string]bool{},
+			Lists:  map[string][]string{},
+		},
+	}
+	if s.path == "" {
+		s.path = defaultFilePath
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, s.save()
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &s.data)
+	if err != nil {
+		return nil, fmt.Errorf("bad state file '%s': %s", s.path, err.Error())
+	}
+	return s, nil
+}
+
+//save writes the data to a temporary file, and then replaces the file with it,
+//so the file is never left half written. Expired values are left out.
+func (s *fileStore) save() error {
+	now := time.Now()
+	for key, value := range s.data.Values {
+		if value.expired(now) {
+			delete(s.data.Values, key)
+		}
+	}
+
+	data, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+//value returns the value of @key, unless it has expired.
+func (s *fileStore) value(key string) (fileValue, bool) {
+	value, ok := s.data.Values[key]
+	if !ok || value.expired(time.Now()) {
+		return fileValue{}, false
+	}
+	return value, true
+}
+
+func (s *fileStore) WithContext(ctx context.Context) Store {
+	return s
+}
+
+func (s *fileStore) Ping() error {
+	_, err := os.Stat(s.path)
+	return err
+}
+
+func (s *fileStore) WriteValue(key string, value string, TTL ...time.Duration) error {
+	return s.WriteIndexed(key, value, nil, TTL...)
+}
+
+func (s *fileStore) GetValue(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, ok := s.value(key)
+	if !ok {
+		return nil, nil
+	}
+
+	//Reset TTL on retrieval, as data is still relevant. It is written along
+	//with the next change, rather than rewriting the file on every read.
+	value.Expires = expiry(nil, s.ttl)
+	s.data.Values[key] = value
+	return []byte(value.Value), nil
+}
+
+func (s *fileStore) PeekValue(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, ok := s.value(key)
+	if !ok {
+		return nil, nil
+	}
+	return []byte(value.Value), nil
+}
+
+func (s *fileStore) PeekValues(keys ...string) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if value, ok := s.value(key); ok {
+			values[i] = []byte(value.Value)
+		}
+	}
+	return values, nil
+}
+
+func (s *fileStore) Increment(key string, TTL time.Duration) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, ok := s.value(key)
+	if !ok {
+		value = fileValue{Value: "0", Expires: expiry([]time.Duration{TTL}, s.ttl)}
+	}
+
+	n, err := strconv.ParseInt(value.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a counter", key)
+	}
+	n++
+	value.Value = strconv.FormatInt(n, 10)
+	s.data.Values[key] = value
+	return n, s.save()
+}
+
+func (s *fileStore) DeleteValue(key string) error {
+	return s.DeleteIndexed([]string{key})
+}
+
+func (s *fileStore) WriteIndexed(
+	key string,
+	value string,
+	indexes []Index,
+	TTL ...time.Duration,
+) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data.Values[key] = fileValue{
+		Value:   value,
+		Expires: expiry(TTL, s.ttl),
+	}
+	for _, index := range indexes {
+		s.add(index.Key, index.Member)
+	}
+	return s.save()
+}
+
+func (s *fileStore) DeleteIndexed(keys []string, indexes ...Index) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, key := range keys {
+		delete(s.data.Values, key)
+		delete(s.data.Sets, key)
+		delete(s.data.Lists, key)
+	}
+	for _, index := range indexes {
+		s.remove(index.Key, index.Member)
+	}
+	return s.save()
+}
+
+func (s *fileStore) add(key string, member string) {
+	if s.data.Sets[key] == nil {
+		s.data.Sets[key] = map[string]bool{}
+	}
+	s.data.Sets[key][member] = true
+}
+
+func (s *fileStore) remove(key string, member string) {
+	delete(s.data.Sets[key], member)
+	if len(s.data.Sets[key]) == 0 {
+		delete(s.data.Sets, key)
+	}
+}
+
+func (s *fileStore) SetMembers(key string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	members := make([]string, 0, len(s.data.Sets[key]))
+	for member := range s.data.Sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *fileStore) AddToSet(key string, members ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, member := range members {
+		s.add(key, member)
+	}
+	return s.save()
+}
+
+func (s *fileStore) RemoveFromSet(key string, members ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, member := range members {
+		s.remove(key, member)
+	}
+	return s.save()
+}
+
+func (s *fileStore) PushToList(key string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data.Lists[key] = append([]string{value}, s.data.Lists[key]...)
+	return s.save()
+}
+
+func (s *fileStore) ListValues(key string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.data.Lists[key]...), nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileGetValueKeepsTTLInMemory(t *testing.T) {
+	f := &File{Path: filepath.Join(t.TempDir(), "state.json")}
+	store, err := f.open(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*fileStore)
+
+	err = s.WriteValue("key", "value", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := s.GetValue("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	read, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != string(written) {
+		t.Fatal("file was rewritten on read")
+	}
+
+	err = s.WriteValue("other", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := f.open(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := reopened.(*fileStore).data.Values["key"].Expires
+	if expires == nil || time.Until(*expires) < 30*time.Minute {
+		t.Fatalf("reset TTL was not written, expires %v", expires)
+	}
+}
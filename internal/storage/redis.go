@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tktip/flyvo-api/internal/redis"
+)
+
+//redisStore is a Store kept in redis.
+type redisStore struct {
+	*redis.Connector
+}
+
+func (s redisStore) WithContext(ctx context.Context) Store {
+	return redisStore{s.Connector.WithContext(ctx)}
+}
+
+//Keys returns the keys matching @pattern. It scans the whole keyspace.
+func (s redisStore) Keys(pattern string) ([]string, error) {
+	keys, err := s.GetList(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, redis.KeyPrefix)
+	}
+	return keys, nil
+}
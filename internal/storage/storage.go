@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tktip/flyvo-api/internal/redis"
+)
+
+const (
+	//BackendRedis - state is kept in redis
+	BackendRedis = "redis"
+	//BackendPostgres - state is kept in postgres, and kept after it expires
+	BackendPostgres = "postgres"
+	//BackendFile - state is kept in a file, for a single node
+	BackendFile = "file"
+
+	defaultTTL = 24 * time.Hour
+)
+
+//Index - a set of members kept along with the values they refer to
+type Index = redis.Index
+
+//Store - where the state of the api is kept. Values expire after their TTL,
+//or the default TTL of the store if none is given. A TTL of 0 never expires.
+type Store interface {
+	//WithContext returns a store whose calls fail once @ctx is done.
+	WithContext(ctx context.Context) Store
+
+	//Ping checks that the store responds.
+	Ping() error
+
+	//WriteValue writes @value to @key.
+	WriteValue(key string, value string, TTL ...time.Duration) error
+	//GetValue returns the value of @key, or nil, and resets its TTL to the
+	//default.
+	GetValue(key string) ([]byte, error)
+	//PeekValue returns the value of @key, or nil, leaving its TTL as is.
+	PeekValue(key string) ([]byte, error)
+	//PeekValues returns the values of @keys, nil for those that do not exist.
+	PeekValues(keys ...string) ([][]byte, error)
+	//Increment increments the counter @key, which expires @TTL after it was
+	//created, and returns the new value.
+	Increment(key string, TTL time.Duration) (int64, error)
+	//DeleteValue deletes @key, whether a value, set or list.
+	DeleteValue(key string) error
+
+	//WriteIndexed writes @value to @key and adds the members to their indexes.
+	WriteIndexed(key string, value string, indexes []Index, TTL ...time.Duration) error
+	//DeleteIndexed deletes @keys and removes the members from their indexes.
+	DeleteIndexed(keys []string, indexes ...Index) error
+	//SetMembers returns the members of set @key.
+	SetMembers(key string) ([]string, error)
+	//AddToSet adds @members to set @key. Sets do not expire.
+	AddToSet(key string, members ...string) error
+	//RemoveFromSet removes @members from set @key.
+	RemoveFromSet(key string, members ...string) error
+
+	//PushToList adds @value to the head of list @key. Lists do not expire.
+	PushToList(key string, value string) error
+	//ListValues returns the values of list @key, from head to tail.
+	ListValues(key string) ([]string, error)
+
+	//Publish publishes @message on @channel.
+	Publish(channel string, message string) error
+	//Subscribe delivers the messages published on @channel until stop is called.
+	Subscribe(channel string) (messages <-chan string, stop func(), err error)
+}
+
+//Scanner - a store that can list its keys, e.g. to index values written
+//before they were indexed
+type Scanner interface {
+	//Keys returns the keys matching the glob @pattern.
+	Keys(pattern string) ([]string, error)
+}
+
+//Config - which backend state is kept in
+type Config struct {
+	//Backend is redis (the default), postgres or file.
+	Backend string `yaml:"backend"`
+
+	//TTL is how long values are kept by default by the postgres and file
+	//backends. Defaults to the ttl of redis, or 24h.
+	TTL time.Duration `yaml:"ttl"`
+
+	Postgres Postgres `yaml:"postgres"`
+	File     File     `yaml:"file"`
+}
+
+//Name - returns the name of the configured backend
+func (c *Config) Name() string {
+	if c.Backend == "" {
+		return BackendRedis
+	}
+	return c.Backend
+}
+
+//Open - returns the store of the configured backend. The redis backend uses @r.
+func (c *Config) Open(r *redis.Connector) (Store, error) {
+	ttl := c.TTL
+	if ttl <= 0 && r != nil {
+		ttl = r.RedisTTL
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	switch c.Name() {
+	case BackendRedis:
+		if r == nil {
+			return nil, errors.New("redis backend requires redis config")
+		}
+		return redisStore{r}, nil
+	case BackendPostgres:
+		return c.Postgres.open(ttl)
+	case BackendFile:
+		return c.File.open(ttl)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", c.Backend)
+	}
+}
+
+//expiry returns when a value written now with @TTL expires, or nil if never.
+func expiry(TTL []time.Duration, defaultTTL time.Duration) *time.Time {
+	ttl := defaultTTL
+	if len(TTL) > 0 {
+		ttl = TTL[0]
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	expires := time.Now().Add(ttl)
+	return &expires
+}
@@ -1,20 +1,194 @@
 package healthcheck
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-api/pkg/metrics"
 )
 
-func health(w http.ResponseWriter, _ *http.Request) {
+const (
+	defaultPort    = "8090"
+	defaultTimeout = 5 * time.Second
+
+	//StatusOK - the component is working
+	StatusOK = "ok"
+	//StatusDegraded - an optional component is failing, but the service works
+	StatusDegraded = "degraded"
+	//StatusFailing - the component is not working
+	StatusFailing = "failing"
+)
+
+var (
+	errTimeout = errors.New("check timed out")
+)
+
+//Check - returns an error if the component it checks is not working
+type Check func() error
+
+type check struct {
+	name     string
+	fn       Check
+	optional bool
+}
+
+//Component - the result of checking one component
+type Component struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+//Report - the result of checking every component
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+//Service - serves liveness, readiness and metrics over http
+type Service struct {
+	//Port to serve on. Defaults to 8090.
+	Port string `yaml:"port"`
+	//Timeout is how long each readiness check may take. Defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	lock   sync.Mutex
+	checks []check
+}
+
+//AddCheck - adds a component that must work for the service to be ready
+func (s *Service) AddCheck(name string, fn Check) {
+	s.add(check{name: name, fn: fn})
+}
+
+//AddOptionalCheck - adds a component that is reported on, but only degrades
+//the service when failing
+func (s *Service) AddOptionalCheck(name string, fn Check) {
+	s.add(check{name: name, fn: fn, optional: true})
+}
+
+func (s *Service) add(c check) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checks = append(s.checks, c)
+}
+
+func (s *Service) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return s.Timeout
+}
+
+//run performs a single check, giving up after the timeout.
+func (s *Service) run(c check) Component {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- c.fn()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(s.timeout()):
+		err = errTimeout
+	}
+
+	comp := Component{
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		comp.Status = StatusFailing
+		comp.Error = err.Error()
+	}
+	return comp
+}
+
+//Ready - checks every component in parallel
+func (s *Service) Ready() Report {
+	s.lock.Lock()
+	checks := append([]check{}, s.checks...)
+	s.lock.Unlock()
+
+	report := Report{
+		Status:     StatusOK,
+		Components: map[string]Component{},
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+			comp := s.run(c)
+
+			lock.Lock()
+			defer lock.Unlock()
+			report.Components[c.name] = comp
+			if comp.Status == StatusOK {
+				return
+			}
+
+			logrus.Warnf("Readiness check '%s' failing: %s", c.name, comp.Error)
+			if !c.optional {
+				report.Status = StatusFailing
+			} else if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func live(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-// StartHealthService starts a health-check service
-func StartHealthService() {
-	http.HandleFunc("/health", health)
-	logrus.Infof("Staring health check on http://localhost:8090/health")
-	if err := http.ListenAndServe(":8090", nil); err != nil {
+func (s *Service) ready(w http.ResponseWriter, _ *http.Request) {
+	report := s.Ready()
+
+	status := http.StatusOK
+	if report.Status == StatusFailing {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		logrus.Errorf("Failed to write readiness report: %s", err.Error())
+	}
+}
+
+//Handler - serves liveness, readiness and metrics
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", live)
+	mux.HandleFunc("/health/live", live)
+	mux.HandleFunc("/health/ready", s.ready)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	return mux
+}
+
+//Start - starts serving the health checks. Blocks until the server fails.
+func (s *Service) Start() {
+	port := s.Port
+	if port == "" {
+		port = defaultPort
+	}
+
+	logrus.Infof("Staring health check on http://localhost:%s/health", port)
+	logrus.Infof("Serving metrics on http://localhost:%s/metrics", port)
+	if err := http.ListenAndServe(":"+port, s.Handler()); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,298 @@
+// Package metrics provides counters, gauges and histograms exposed in the
+// prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	//labelEscaper escapes label values as the exposition format requires.
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	//helpEscaper escapes help texts, in which quotes are kept as is.
+	helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+	//DefaultBuckets are histogram buckets in seconds, suited to request latency.
+	DefaultBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 15, 30}
+
+	registry = struct {
+		sync.Mutex
+		metrics map[string]metric
+	}{metrics: map[string]metric{}}
+)
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+//register stores m under name, or returns the metric already registered with
+//that name, so several packages may share a metric.
+func register(name string, m metric) metric {
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, ok := registry.metrics[name]; ok {
+		return existing
+	}
+	registry.metrics[name] = m
+	return m
+}
+
+//series holds one value per combination of label values.
+type series struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+func newSeries(name, help, kind string, labels []string) *series {
+	return &series{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]float64{},
+	}
+}
+
+func (s *series) key(labelValues []string) string {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d",
+			s.name, len(s.labels), len(labelValues)))
+	}
+	return formatLabels(s.labels, labelValues)
+}
+
+func (s *series) add(v float64, labelValues []string) {
+	key := s.key(labelValues)
+	s.Lock()
+	s.values[key] += v
+	s.Unlock()
+}
+
+func (s *series) set(v float64, labelValues []string) {
+	key := s.key(labelValues)
+	s.Lock()
+	s.values[key] = v
+	s.Unlock()
+}
+
+func (s *series) write(buf *bytes.Buffer) {
+	s.Lock()
+	defer s.Unlock()
+	writeHeader(buf, s.name, s.help, s.kind)
+	for _, key := range sortedKeys(s.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", s.name, key, formatFloat(s.values[key]))
+	}
+}
+
+//Counter - a value that only goes up
+type Counter struct {
+	*series
+}
+
+//NewCounter - registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return register(name, &Counter{newSeries(name, help, "counter", labels)}).(*Counter)
+}
+
+//Inc - increments the counter for the label values by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+//Gauge - a value that may go up and down
+type Gauge struct {
+	*series
+}
+
+//NewGauge - registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return register(name, &Gauge{newSeries(name, help, "gauge", labels)}).(*Gauge)
+}
+
+//Set - sets the gauge for the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.set(v, labelValues)
+}
+
+//GaugeFunc - a gauge whose value is read when scraped
+type GaugeFunc struct {
+	sync.Mutex
+	name string
+	help string
+	fn   func() float64
+}
+
+//NewGaugeFunc - registers a gauge reading its value from fn
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := register(name, &GaugeFunc{name: name, help: help}).(*GaugeFunc)
+	g.SetFunc(fn)
+	return g
+}
+
+//SetFunc - replaces the function the gauge reads its value from
+func (g *GaugeFunc) SetFunc(fn func() float64) {
+	g.Lock()
+	g.fn = fn
+	g.Unlock()
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	g.Lock()
+	fn := g.fn
+	g.Unlock()
+	writeHeader(buf, g.name, g.help, "gauge")
+	fmt.Fprintf(buf, "%s %s\n", g.name, formatFloat(fn()))
+}
+
+//Histogram - counts observations in buckets
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+//NewHistogram - registers a histogram with the given buckets and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return register(name, &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: sorted,
+		values:  map[string]*histogramValue{},
+	}).(*Histogram)
+}
+
+//Observe - adds an observation for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d",
+			h.name, len(h.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	h.Lock()
+	defer h.Unlock()
+	val, ok := h.values[key]
+	if !ok {
+		val = &histogramValue{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = val
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			val.counts[i]++
+		}
+	}
+	val.count++
+	val.sum += v
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(buf, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		val := h.values[key]
+		for i, upper := range h.buckets {
+			lbl := formatLabels(labels, append(append([]string{}, val.labelValues...),
+				formatFloat(upper)))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, lbl, val.counts[i])
+		}
+		lbl := formatLabels(labels, append(append([]string{}, val.labelValues...), "+Inf"))
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, lbl, val.count)
+
+		lbl = formatLabels(h.labels, val.labelValues)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, lbl, formatFloat(val.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, lbl, val.count)
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Handler - writes all registered metrics in the prometheus text format
+func Handler(w http.ResponseWriter, _ *http.Request) {
+	registry.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	registry.Unlock()
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		registry.Lock()
+		m := registry.metrics[name]
+		registry.Unlock()
+		m.write(buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
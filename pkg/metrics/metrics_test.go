@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", `{l="plain"}`},
+		{`back\slash`, `{l="back\\slash"}`},
+		{`"quoted"`, `{l="\"quoted\""}`},
+		{"line\nbreak", `{l="line\nbreak"}`},
+		{"tab\there", "{l=\"tab\there\"}"},
+		{"æøå", `{l="æøå"}`},
+		{"\xff", "{l=\"\xff\"}"},
+	}
+	for _, test := range tests {
+		got := formatLabels([]string{"l"}, []string{test.value})
+		if got != test.want {
+			t.Errorf("formatLabels(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_write_total", "Help with \\ and \"quotes\"\nover lines.", "a", "b")
+	c.Inc("x", `y"z`)
+	c.Inc("x", `y"z`)
+	c.Inc(`\`, "\n")
+
+	h := NewHistogram("test_write_seconds", "Histogram.", []float64{2, 1}, "a")
+	h.Observe(1.5, `"`)
+
+	rec := httptest.NewRecorder()
+	Handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+
+	for _, want := range []string{
+		"# HELP test_write_total Help with \\\\ and \"quotes\"\\nover lines.\n" +
+			"# TYPE test_write_total counter\n" +
+			"test_write_total{a=\"\\\\\",b=\"\\n\"} 1\n" +
+			"test_write_total{a=\"x\",b=\"y\\\"z\"} 2\n",
+		"# HELP test_write_seconds Histogram.\n" +
+			"# TYPE test_write_seconds histogram\n" +
+			"test_write_seconds_bucket{a=\"\\\"\",le=\"1\"} 0\n" +
+			"test_write_seconds_bucket{a=\"\\\"\",le=\"2\"} 1\n" +
+			"test_write_seconds_bucket{a=\"\\\"\",le=\"+Inf\"} 1\n" +
+			"test_write_seconds_sum{a=\"\\\"\"} 1.5\n" +
+			"test_write_seconds_count{a=\"\\\"\"} 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output does not contain\n%s\ngot\n%s", want, got)
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	g := NewGaugeFunc("test_gauge_func", "Gauge.", func() float64 { return 3 })
+	buf := &bytes.Buffer{}
+	g.write(buf)
+	want := "# HELP test_gauge_func Gauge.\n# TYPE test_gauge_func gauge\ntest_gauge_func 3\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
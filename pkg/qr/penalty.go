@@ -0,0 +1,93 @@
+package qr
+
+const (
+	penaltyRun     = 3
+	penaltyBlock   = 3
+	penaltyFinder  = 40
+	penaltyBalance = 10
+)
+
+//penalty scores how hard the code is to read, the lower the better.
+func (c *Code) penalty() int {
+	result := 0
+	for i := 0; i < c.Size; i++ {
+		result += c.linePenalty(func(j int) bool { return c.modules[i][j] })
+		result += c.linePenalty(func(j int) bool { return c.modules[j][i] })
+	}
+
+	for y := 0; y < c.Size-1; y++ {
+		for x := 0; x < c.Size-1; x++ {
+			color := c.modules[y][x]
+			if color == c.modules[y][x+1] &&
+				color == c.modules[y+1][x] &&
+				color == c.modules[y+1][x+1] {
+				result += penaltyBlock
+			}
+		}
+	}
+
+	dark := 0
+	for _, row := range c.modules {
+		for _, module := range row {
+			if module {
+				dark++
+			}
+		}
+	}
+	total := c.Size * c.Size
+	//Five points of penalty per 5% the dark share strays from 50%.
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return result + k*penaltyBalance
+}
+
+var (
+	finderLike = []bool{true, false, true, true, true, false, true}
+)
+
+//linePenalty scores runs of five or more modules of the same color, and
+//patterns looking like finders, in a row or column.
+func (c *Code) linePenalty(module func(int) bool) int {
+	result := 0
+	run := 0
+	for j := 0; j < c.Size; j++ {
+		if j > 0 && module(j) == module(j-1) {
+			run++
+		} else {
+			run = 1
+		}
+		if run == 5 {
+			result += penaltyRun
+		} else if run > 5 {
+			result++
+		}
+	}
+
+	//Finder-like patterns with four light modules on either side, counting
+	//modules beyond the edge as light.
+	light := func(from, to int) bool {
+		for j := from; j < to; j++ {
+			if j >= 0 && j < c.Size && module(j) {
+				return false
+			}
+		}
+		return true
+	}
+	for j := 0; j+len(finderLike) <= c.Size; j++ {
+		matches := true
+		for k, dark := range finderLike {
+			if module(j+k) != dark {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		end := j + len(finderLike)
+		if light(j-4, j) || light(end, end+4) {
+			result += penaltyFinder
+		}
+	}
+	return result
+}
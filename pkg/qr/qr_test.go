@@ -0,0 +1,310 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+//bits parses a string of 0s and 1s, most significant bit first.
+func bits(s string) int {
+	result := 0
+	for _, r := range s {
+		result = result<<1 | int(r-'0')
+	}
+	return result
+}
+
+//readFormatBits reads the format information around the top left finder.
+func readFormatBits(c *Code) int {
+	result := 0
+	for i := 0; i <= 5; i++ {
+		result |= boolBit(c.Dark(8, i)) << uint(i)
+	}
+	result |= boolBit(c.Dark(8, 7)) << 6
+	result |= boolBit(c.Dark(8, 8)) << 7
+	result |= boolBit(c.Dark(7, 8)) << 8
+	for i := 9; i < 15; i++ {
+		result |= boolBit(c.Dark(14-i, 8)) << uint(i)
+	}
+	return result
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//Format information after masking, from annex C of the spec and its table C.1.
+func TestFormatBits(t *testing.T) {
+	tests := []struct {
+		level Level
+		mask  int
+		want  string
+	}{
+		{M, 5, "100000011001110"},
+		{L, 0, "111011111000100"},
+		{L, 7, "110100101110110"},
+		{M, 0, "101010000010010"},
+		{M, 7, "100101010100000"},
+		{Q, 0, "011010101011111"},
+		{Q, 1, "011000001101000"},
+		{Q, 4, "010010010110100"},
+		{H, 0, "001011010001001"},
+		{H, 7, "000100000111011"},
+	}
+	for _, test := range tests {
+		c := newCode(1, test.level)
+		c.drawFormatBits(test.mask)
+		if got := readFormatBits(c); got != bits(test.want) {
+			t.Errorf("level %d mask %d: format bits %015b, want %s",
+				test.level, test.mask, got, test.want)
+		}
+	}
+}
+
+//Version information, from table D.1 of the spec.
+func TestVersionBits(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{7, "000111110010010100"},
+		{8, "001000010110111100"},
+		{21, "010101011010000011"},
+		{40, "101000110001101001"},
+	}
+	for _, test := range tests {
+		c := newCode(test.version, L)
+		c.drawVersion()
+		got, mirrored := 0, 0
+		for i := 0; i < 18; i++ {
+			a, b := c.Size-11+i%3, i/3
+			got |= boolBit(c.Dark(a, b)) << uint(i)
+			mirrored |= boolBit(c.Dark(b, a)) << uint(i)
+		}
+		if got != bits(test.want) || mirrored != bits(test.want) {
+			t.Errorf("version %d: version bits %018b and %018b, want %s",
+				test.version, got, mirrored, test.want)
+		}
+	}
+}
+
+//Generator polynomials, from annex A of the spec.
+func TestReedSolomonDivisor(t *testing.T) {
+	tests := []struct {
+		degree int
+		want   []byte
+	}{
+		{7, []byte{127, 122, 154, 164, 11, 68, 117}},
+		{10, []byte{216, 194, 159, 111, 199, 94, 95, 113, 157, 193}},
+	}
+	for _, test := range tests {
+		got := reedSolomonDivisor(test.degree)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("degree %d: got %v, want %v", test.degree, got, test.want)
+		}
+	}
+}
+
+//Error correction codewords of version 1-M symbols.
+func TestReedSolomonRemainder(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{
+			"01234567, annex I of the spec",
+			[]byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11,
+				0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55},
+		},
+		{
+			"HELLO WORLD",
+			[]byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+			[]byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+		},
+	}
+	for _, test := range tests {
+		got := reedSolomonRemainder(test.data, reedSolomonDivisor(len(test.want)))
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+//Alignment pattern centers, from table E.1 of the spec.
+func TestAlignmentPositions(t *testing.T) {
+	tests := []struct {
+		version int
+		want    []int
+	}{
+		{1, nil},
+		{2, []int{6, 18}},
+		{7, []int{6, 22, 38}},
+		{14, []int{6, 26, 46, 66}},
+		{32, []int{6, 34, 60, 86, 112, 138}},
+		{36, []int{6, 24, 50, 76, 102, 128, 154}},
+		{40, []int{6, 30, 58, 86, 114, 142, 170}},
+	}
+	for _, test := range tests {
+		got := newCode(test.version, L).alignmentPositions()
+		if len(got) != len(test.want) {
+			t.Errorf("version %d: got %v, want %v", test.version, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("version %d: got %v, want %v", test.version, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+//Byte mode capacities, from table 7 of the spec.
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		version  int
+		level    Level
+		capacity int
+	}{
+		{1, L, 17},
+		{1, M, 14},
+		{1, Q, 11},
+		{1, H, 7},
+		{2, M, 26},
+		{7, Q, 86},
+		{10, L, 271},
+		{10, M, 213},
+		{10, H, 119},
+		{40, L, 2953},
+		{40, M, 2331},
+		{40, Q, 1663},
+		{40, H, 1273},
+	}
+	for _, test := range tests {
+		c, err := Encode(strings.Repeat("a", test.capacity), test.level)
+		if err != nil || c.Version != test.version {
+			t.Errorf("%d bytes at level %d: got %v, %v, want version %d",
+				test.capacity, test.level, c, err, test.version)
+		}
+		c, err = Encode(strings.Repeat("a", test.capacity+1), test.level)
+		if test.version == maxVersion {
+			if err != ErrTooLong {
+				t.Errorf("%d bytes at level %d: got error %v, want %v",
+					test.capacity+1, test.level, err, ErrTooLong)
+			}
+		} else if err != nil || c.Version != test.version+1 {
+			t.Errorf("%d bytes at level %d: got %v, %v, want version %d",
+				test.capacity+1, test.level, c, err, test.version+1)
+		}
+	}
+}
+
+//readCodewords unmasks the code and reads its codewords in placement order.
+func readCodewords(c *Code, mask int) []byte {
+	var result []byte
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.isFunction[y][x] {
+					continue
+				}
+				if i%8 == 0 {
+					result = append(result, 0)
+				}
+				if c.Dark(x, y) != masked(mask, x, y) {
+					result[i/8] |= 1 << uint(7-i%8)
+				}
+				i++
+			}
+		}
+	}
+	return result[:rawDataModules(c.Version)/8]
+}
+
+//Encoded codes read back as the data, with valid error correction.
+func TestEncodeReadBack(t *testing.T) {
+	tests := []struct {
+		data  string
+		level Level
+	}{
+		{"", L},
+		{"https://example.com/", M},
+		{"æøå", Q},
+		{strings.Repeat("0123456789", 30), H},
+		{strings.Repeat("flyvo", 100), M},
+	}
+	for _, test := range tests {
+		c, err := Encode(test.data, test.level)
+		if err != nil {
+			t.Errorf("%q: %v", test.data, err)
+			continue
+		}
+
+		format := readFormatBits(c) ^ 0x5412
+		if format>>13 != formatLevel[test.level] {
+			t.Errorf("%q: level bits %02b, want %02b",
+				test.data, format>>13, formatLevel[test.level])
+		}
+		mask := format >> 10 & 7
+		check := newCode(1, test.level)
+		check.drawFormatBits(mask)
+		if readFormatBits(check) != readFormatBits(c) {
+			t.Errorf("%q: invalid format bits %015b", test.data, readFormatBits(c))
+		}
+
+		//Undo the interleaving, checking the error correction of each block.
+		codewords := readCodewords(c, mask)
+		numBlocks := eccBlocks[test.level][c.Version]
+		eccLen := eccPerBlock[test.level][c.Version]
+		numShort := numBlocks - len(codewords)%numBlocks
+		shortLen := len(codewords)/numBlocks - eccLen
+		blocks := make([][]byte, numBlocks)
+		k := 0
+		for i := 0; i <= shortLen; i++ {
+			for j := range blocks {
+				if i < shortLen || j >= numShort {
+					blocks[j] = append(blocks[j], codewords[k])
+					k++
+				}
+			}
+		}
+		var data []byte
+		for j, block := range blocks {
+			data = append(data, block...)
+			got := make([]byte, eccLen)
+			for i := range got {
+				got[i] = codewords[k+i*numBlocks+j]
+			}
+			want := reedSolomonRemainder(block, reedSolomonDivisor(eccLen))
+			if !bytes.Equal(got, want) {
+				t.Errorf("%q: block %d error correction %v, want %v", test.data, j, got, want)
+			}
+		}
+
+		bits := &bitBuffer{}
+		bits.append(0x4, 4)
+		bits.append(len(test.data), countBits(c.Version))
+		for _, b := range []byte(test.data) {
+			bits.append(int(b), 8)
+		}
+		bits.append(0, (8-len(*bits)%8)%8)
+		prefix := bits.bytes()
+		if len(data) < len(prefix) || !bytes.Equal(data[:len(prefix)], prefix) {
+			t.Errorf("%q: data codewords %v, want prefix %v", test.data, data, prefix)
+		}
+	}
+}
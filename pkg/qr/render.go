@@ -0,0 +1,74 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+const (
+	//quietZone is the light border around the code, in modules.
+	quietZone = 4
+)
+
+//scale returns the number of pixels per module, so the code with its quiet
+//zone fits within size pixels, but at least one.
+func (c *Code) scale(size int) int {
+	scale := size / (c.Size + 2*quietZone)
+	if scale < 1 {
+		return 1
+	}
+	return scale
+}
+
+//Image - renders the code, with a quiet zone, at most size pixels wide
+func (c *Code) Image(size int) image.Image {
+	scale := c.scale(size)
+	width := (c.Size + 2*quietZone) * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{
+		color.White,
+		color.Black,
+	})
+	for y := 0; y < width; y++ {
+		for x := 0; x < width; x++ {
+			if c.Dark(x/scale-quietZone, y/scale-quietZone) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+//PNG - renders the code as a PNG image, at most size pixels wide
+func (c *Code) PNG(size int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, c.Image(size))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//SVG - renders the code as an SVG image, size pixels wide
+func (c *Code) SVG(size int) string {
+	width := c.Size + 2*quietZone
+
+	path := &strings.Builder{}
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" version="1.1" `+
+		`width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+
+		`<path d="%s" fill="#000000"/></svg>`,
+		size, size, width, width, path.String())
+}
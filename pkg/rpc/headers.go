@@ -0,0 +1,7 @@
+package rpc
+
+const (
+	//HeaderIdempotencyKey - identifies a write, so the client can recognize and
+	//ignore repeats of writes it has already processed
+	HeaderIdempotencyKey = "idempotencyKey"
+)